@@ -0,0 +1,325 @@
+// gRPC control service of ws-kent for backend services, requests go through the
+// same queues, audit log and report correlation as the websocket ones. With an
+// auth file, calls carry a token in "authorization: Bearer <token>" metadata.
+//
+// Kent messages travel serialized, so this file doesn't depend on where the kent
+// module keeps kent.proto. Unmarshal them with the kentpb package.
+//
+// Regenerate the Go code with `make proto`.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.28.0
+// 	protoc        (unknown)
+// source: kentcontrol.proto
+
+package kentcontrol
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type DeviceCommand struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	DispenserId string `protobuf:"bytes,1,opt,name=dispenser_id,json=dispenserId,proto3" json:"dispenser_id,omitempty"`
+	// A serialized kent SrvToCli
+	Req []byte `protobuf:"bytes,2,opt,name=req,proto3" json:"req,omitempty"`
+}
+
+func (x *DeviceCommand) Reset() {
+	*x = DeviceCommand{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_kentcontrol_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DeviceCommand) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeviceCommand) ProtoMessage() {}
+
+func (x *DeviceCommand) ProtoReflect() protoreflect.Message {
+	mi := &file_kentcontrol_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeviceCommand.ProtoReflect.Descriptor instead.
+func (*DeviceCommand) Descriptor() ([]byte, []int) {
+	return file_kentcontrol_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *DeviceCommand) GetDispenserId() string {
+	if x != nil {
+		return x.DispenserId
+	}
+	return ""
+}
+
+func (x *DeviceCommand) GetReq() []byte {
+	if x != nil {
+		return x.Req
+	}
+	return nil
+}
+
+type DeviceFilter struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Every dispenser when empty
+	DispenserIds []string `protobuf:"bytes,1,rep,name=dispenser_ids,json=dispenserIds,proto3" json:"dispenser_ids,omitempty"`
+	// Every report when empty, ex: EepromRRpt
+	Reports []string `protobuf:"bytes,2,rep,name=reports,proto3" json:"reports,omitempty"`
+}
+
+func (x *DeviceFilter) Reset() {
+	*x = DeviceFilter{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_kentcontrol_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DeviceFilter) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeviceFilter) ProtoMessage() {}
+
+func (x *DeviceFilter) ProtoReflect() protoreflect.Message {
+	mi := &file_kentcontrol_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeviceFilter.ProtoReflect.Descriptor instead.
+func (*DeviceFilter) Descriptor() ([]byte, []int) {
+	return file_kentcontrol_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *DeviceFilter) GetDispenserIds() []string {
+	if x != nil {
+		return x.DispenserIds
+	}
+	return nil
+}
+
+func (x *DeviceFilter) GetReports() []string {
+	if x != nil {
+		return x.Reports
+	}
+	return nil
+}
+
+type DeviceReport struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	DispenserId string `protobuf:"bytes,1,opt,name=dispenser_id,json=dispenserId,proto3" json:"dispenser_id,omitempty"`
+	// A serialized kent CliToSrv
+	Rpt []byte `protobuf:"bytes,2,opt,name=rpt,proto3" json:"rpt,omitempty"`
+}
+
+func (x *DeviceReport) Reset() {
+	*x = DeviceReport{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_kentcontrol_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DeviceReport) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeviceReport) ProtoMessage() {}
+
+func (x *DeviceReport) ProtoReflect() protoreflect.Message {
+	mi := &file_kentcontrol_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeviceReport.ProtoReflect.Descriptor instead.
+func (*DeviceReport) Descriptor() ([]byte, []int) {
+	return file_kentcontrol_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *DeviceReport) GetDispenserId() string {
+	if x != nil {
+		return x.DispenserId
+	}
+	return ""
+}
+
+func (x *DeviceReport) GetRpt() []byte {
+	if x != nil {
+		return x.Rpt
+	}
+	return nil
+}
+
+var File_kentcontrol_proto protoreflect.FileDescriptor
+
+var file_kentcontrol_proto_rawDesc = []byte{
+	0x0a, 0x11, 0x6b, 0x65, 0x6e, 0x74, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x12, 0x0b, 0x6b, 0x65, 0x6e, 0x74, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c,
+	0x22, 0x44, 0x0a, 0x0d, 0x44, 0x65, 0x76, 0x69, 0x63, 0x65, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e,
+	0x64, 0x12, 0x21, 0x0a, 0x0c, 0x64, 0x69, 0x73, 0x70, 0x65, 0x6e, 0x73, 0x65, 0x72, 0x5f, 0x69,
+	0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x64, 0x69, 0x73, 0x70, 0x65, 0x6e, 0x73,
+	0x65, 0x72, 0x49, 0x64, 0x12, 0x10, 0x0a, 0x03, 0x72, 0x65, 0x71, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x0c, 0x52, 0x03, 0x72, 0x65, 0x71, 0x22, 0x4d, 0x0a, 0x0c, 0x44, 0x65, 0x76, 0x69, 0x63, 0x65,
+	0x46, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x12, 0x23, 0x0a, 0x0d, 0x64, 0x69, 0x73, 0x70, 0x65, 0x6e,
+	0x73, 0x65, 0x72, 0x5f, 0x69, 0x64, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0c, 0x64,
+	0x69, 0x73, 0x70, 0x65, 0x6e, 0x73, 0x65, 0x72, 0x49, 0x64, 0x73, 0x12, 0x18, 0x0a, 0x07, 0x72,
+	0x65, 0x70, 0x6f, 0x72, 0x74, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x07, 0x72, 0x65,
+	0x70, 0x6f, 0x72, 0x74, 0x73, 0x22, 0x43, 0x0a, 0x0c, 0x44, 0x65, 0x76, 0x69, 0x63, 0x65, 0x52,
+	0x65, 0x70, 0x6f, 0x72, 0x74, 0x12, 0x21, 0x0a, 0x0c, 0x64, 0x69, 0x73, 0x70, 0x65, 0x6e, 0x73,
+	0x65, 0x72, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x64, 0x69, 0x73,
+	0x70, 0x65, 0x6e, 0x73, 0x65, 0x72, 0x49, 0x64, 0x12, 0x10, 0x0a, 0x03, 0x72, 0x70, 0x74, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x03, 0x72, 0x70, 0x74, 0x32, 0x91, 0x01, 0x0a, 0x0b, 0x4b,
+	0x65, 0x6e, 0x74, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x12, 0x3d, 0x0a, 0x04, 0x53, 0x65,
+	0x6e, 0x64, 0x12, 0x1a, 0x2e, 0x6b, 0x65, 0x6e, 0x74, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c,
+	0x2e, 0x44, 0x65, 0x76, 0x69, 0x63, 0x65, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x1a, 0x19,
+	0x2e, 0x6b, 0x65, 0x6e, 0x74, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x2e, 0x44, 0x65, 0x76,
+	0x69, 0x63, 0x65, 0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x12, 0x43, 0x0a, 0x09, 0x53, 0x75, 0x62,
+	0x73, 0x63, 0x72, 0x69, 0x62, 0x65, 0x12, 0x19, 0x2e, 0x6b, 0x65, 0x6e, 0x74, 0x63, 0x6f, 0x6e,
+	0x74, 0x72, 0x6f, 0x6c, 0x2e, 0x44, 0x65, 0x76, 0x69, 0x63, 0x65, 0x46, 0x69, 0x6c, 0x74, 0x65,
+	0x72, 0x1a, 0x19, 0x2e, 0x6b, 0x65, 0x6e, 0x74, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x2e,
+	0x44, 0x65, 0x76, 0x69, 0x63, 0x65, 0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x30, 0x01, 0x42, 0x24,
+	0x5a, 0x22, 0x6b, 0x65, 0x6e, 0x74, 0x2d, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x2d, 0x69,
+	0x6e, 0x74, 0x65, 0x72, 0x66, 0x61, 0x63, 0x65, 0x2f, 0x6b, 0x65, 0x6e, 0x74, 0x63, 0x6f, 0x6e,
+	0x74, 0x72, 0x6f, 0x6c, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_kentcontrol_proto_rawDescOnce sync.Once
+	file_kentcontrol_proto_rawDescData = file_kentcontrol_proto_rawDesc
+)
+
+func file_kentcontrol_proto_rawDescGZIP() []byte {
+	file_kentcontrol_proto_rawDescOnce.Do(func() {
+		file_kentcontrol_proto_rawDescData = protoimpl.X.CompressGZIP(file_kentcontrol_proto_rawDescData)
+	})
+	return file_kentcontrol_proto_rawDescData
+}
+
+var file_kentcontrol_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_kentcontrol_proto_goTypes = []interface{}{
+	(*DeviceCommand)(nil), // 0: kentcontrol.DeviceCommand
+	(*DeviceFilter)(nil),  // 1: kentcontrol.DeviceFilter
+	(*DeviceReport)(nil),  // 2: kentcontrol.DeviceReport
+}
+var file_kentcontrol_proto_depIdxs = []int32{
+	0, // 0: kentcontrol.KentControl.Send:input_type -> kentcontrol.DeviceCommand
+	1, // 1: kentcontrol.KentControl.Subscribe:input_type -> kentcontrol.DeviceFilter
+	2, // 2: kentcontrol.KentControl.Send:output_type -> kentcontrol.DeviceReport
+	2, // 3: kentcontrol.KentControl.Subscribe:output_type -> kentcontrol.DeviceReport
+	2, // [2:4] is the sub-list for method output_type
+	0, // [0:2] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_kentcontrol_proto_init() }
+func file_kentcontrol_proto_init() {
+	if File_kentcontrol_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_kentcontrol_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*DeviceCommand); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_kentcontrol_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*DeviceFilter); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_kentcontrol_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*DeviceReport); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_kentcontrol_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   3,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_kentcontrol_proto_goTypes,
+		DependencyIndexes: file_kentcontrol_proto_depIdxs,
+		MessageInfos:      file_kentcontrol_proto_msgTypes,
+	}.Build()
+	File_kentcontrol_proto = out.File
+	file_kentcontrol_proto_rawDesc = nil
+	file_kentcontrol_proto_goTypes = nil
+	file_kentcontrol_proto_depIdxs = nil
+}
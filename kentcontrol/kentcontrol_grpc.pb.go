@@ -0,0 +1,171 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: kentcontrol.proto
+
+package kentcontrol
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// KentControlClient is the client API for KentControl service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type KentControlClient interface {
+	// The report answering the request, without rpt for requests that have none
+	Send(ctx context.Context, in *DeviceCommand, opts ...grpc.CallOption) (*DeviceReport, error)
+	Subscribe(ctx context.Context, in *DeviceFilter, opts ...grpc.CallOption) (KentControl_SubscribeClient, error)
+}
+
+type kentControlClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewKentControlClient(cc grpc.ClientConnInterface) KentControlClient {
+	return &kentControlClient{cc}
+}
+
+func (c *kentControlClient) Send(ctx context.Context, in *DeviceCommand, opts ...grpc.CallOption) (*DeviceReport, error) {
+	out := new(DeviceReport)
+	err := c.cc.Invoke(ctx, "/kentcontrol.KentControl/Send", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kentControlClient) Subscribe(ctx context.Context, in *DeviceFilter, opts ...grpc.CallOption) (KentControl_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &KentControl_ServiceDesc.Streams[0], "/kentcontrol.KentControl/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &kentControlSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type KentControl_SubscribeClient interface {
+	Recv() (*DeviceReport, error)
+	grpc.ClientStream
+}
+
+type kentControlSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *kentControlSubscribeClient) Recv() (*DeviceReport, error) {
+	m := new(DeviceReport)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// KentControlServer is the server API for KentControl service.
+// All implementations must embed UnimplementedKentControlServer
+// for forward compatibility
+type KentControlServer interface {
+	// The report answering the request, without rpt for requests that have none
+	Send(context.Context, *DeviceCommand) (*DeviceReport, error)
+	Subscribe(*DeviceFilter, KentControl_SubscribeServer) error
+	mustEmbedUnimplementedKentControlServer()
+}
+
+// UnimplementedKentControlServer must be embedded to have forward compatible implementations.
+type UnimplementedKentControlServer struct {
+}
+
+func (UnimplementedKentControlServer) Send(context.Context, *DeviceCommand) (*DeviceReport, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Send not implemented")
+}
+func (UnimplementedKentControlServer) Subscribe(*DeviceFilter, KentControl_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedKentControlServer) mustEmbedUnimplementedKentControlServer() {}
+
+// UnsafeKentControlServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to KentControlServer will
+// result in compilation errors.
+type UnsafeKentControlServer interface {
+	mustEmbedUnimplementedKentControlServer()
+}
+
+func RegisterKentControlServer(s grpc.ServiceRegistrar, srv KentControlServer) {
+	s.RegisterService(&KentControl_ServiceDesc, srv)
+}
+
+func _KentControl_Send_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeviceCommand)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KentControlServer).Send(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kentcontrol.KentControl/Send",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KentControlServer).Send(ctx, req.(*DeviceCommand))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KentControl_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DeviceFilter)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KentControlServer).Subscribe(m, &kentControlSubscribeServer{stream})
+}
+
+type KentControl_SubscribeServer interface {
+	Send(*DeviceReport) error
+	grpc.ServerStream
+}
+
+type kentControlSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *kentControlSubscribeServer) Send(m *DeviceReport) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// KentControl_ServiceDesc is the grpc.ServiceDesc for KentControl service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var KentControl_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "kentcontrol.KentControl",
+	HandlerType: (*KentControlServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Send",
+			Handler:    _KentControl_Send_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _KentControl_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "kentcontrol.proto",
+}
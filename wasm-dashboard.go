@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall/js"
+	"time"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+)
+
+/*
+Fleet dashboard, one card per connected device with its type, operating state,
+last report and active alarms. Clicking a card scopes the control panels to it.
+Only the selected device sends every report, the dashboard watches the reports
+below from the others.
+*/
+
+/*
+dashboardReports - The reports the dashboard gets from every device: the EEPROM
+for the device type, the state reports and the responses whose failure is shown
+as an alarm.
+*/
+var dashboardReports = []string{
+	"EepromRRpt",
+	"DispenserStateRpt",
+	"FryerStateRpt",
+	"DispenserProcessResp",
+	"FryerUnlockFreezerResponse",
+	"FryerCookModeResponse",
+	"FryerHotHoldResponse",
+	"FryerFreezerResp",
+}
+
+/*
+deviceStatus - What the dashboard knows of a device from its reports.
+*/
+type deviceStatus struct {
+	deviceType string
+	state      string
+	alarms     map[string]string
+	lastSeen   time.Time
+}
+
+/*
+dashboardCard - The card of a device and its click handler, released with the card.
+*/
+type dashboardCard struct {
+	element js.Value
+	onClick js.Func
+}
+
+/*
+status - The dashboard status of a device, created on its first report.
+*/
+func (ctx *Ctx) status(id string) *deviceStatus {
+
+	st, ok := ctx.fleet[id]
+	if !ok {
+		st = &deviceStatus{alarms: make(map[string]string)}
+		ctx.fleet[id] = st
+	}
+	return st
+}
+
+/*
+updateStatus - Update the dashboard from a report of any device.
+*/
+func (ctx *Ctx) updateStatus(id string, rpt *kentpb.CliToSrv, at time.Time) {
+
+	st := ctx.status(id)
+	if at.After(st.lastSeen) {
+		st.lastSeen = at
+	}
+
+	switch r := rpt.GetRptOneof().(type) {
+	case *kentpb.CliToSrv_EepromRRpt:
+		if factory := r.EepromRRpt.GetFactoryRpt(); factory != nil {
+			st.deviceType = deviceTypeName(factory.GetDeviceType())
+		}
+	case *kentpb.CliToSrv_FryerStateRpt:
+		st.state = fmt.Sprint(r.FryerStateRpt.GetState())
+	case *kentpb.CliToSrv_DispenserStateRpt:
+		st.state = fmt.Sprint(r.DispenserStateRpt.GetState())
+	case *kentpb.CliToSrv_DispenserProcessResp:
+		st.alarm("Dispense", r.DispenserProcessResp)
+	case *kentpb.CliToSrv_FryerUnlockFreezerResponse:
+		st.alarm("Freezer drawer", r.FryerUnlockFreezerResponse)
+	case *kentpb.CliToSrv_FryerCookModeResponse:
+		st.alarm("Cook", r.FryerCookModeResponse)
+	case *kentpb.CliToSrv_FryerHotHoldResponse:
+		st.alarm("Hot hold", r.FryerHotHoldResponse)
+	case *kentpb.CliToSrv_FryerFreezerResp:
+		st.alarm("Freezer", r.FryerFreezerResp)
+	}
+
+	ctx.renderCard(id)
+}
+
+/*
+alarm - Raise the alarm of an operation whose response failed, or clear it once
+the operation succeeds again.
+*/
+func (st *deviceStatus) alarm(operation string, resp *kentpb.GenericResponse) {
+
+	key := fmt.Sprintf("%s %d", operation, resp.GetIdx())
+	if resp.GetResult() == 0 {
+		delete(st.alarms, key)
+		return
+	}
+	st.alarms[key] = fmt.Sprintf("%s failed (%d)", key, resp.GetResult())
+}
+
+/*
+deviceTypeName - The device type as labelled in the Factory panel.
+*/
+func deviceTypeName(t kentpb.EepromFactoryData_DeviceType) string {
+
+	option := js.Global().Get("document").Call("querySelector", fmt.Sprintf("#cmbFactoryType option[value='%d']", int(t)))
+	if option.IsNull() {
+		return t.String()
+	}
+	return option.Get("text").String()
+}
+
+/*
+renderDashboard - Add a card for every device that came online and remove the
+cards of those that went offline, then highlight the selected one. The cards
+already shown are not redrawn, see renderCard.
+*/
+func (ctx *Ctx) renderDashboard() {
+
+	dashboard := ctx.getElementByID("divDashboard")
+
+	for id, card := range ctx.cards {
+		if _, ok := ctx.devices[id]; !ok {
+			card.element.Call("remove")
+			card.onClick.Release()
+			delete(ctx.cards, id)
+		}
+	}
+
+	if len(ctx.devices) == 0 {
+		dashboard.Set("innerText", "No device connected")
+		return
+	}
+	if len(ctx.cards) == 0 {
+		dashboard.Set("innerText", "")
+	}
+
+	ids := make([]string, 0, len(ctx.devices))
+	for id := range ctx.devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	selected := ctx.getDispenserID()
+	for _, id := range ids {
+		card, ok := ctx.cards[id]
+		if !ok {
+			card = ctx.newCard(id)
+			ctx.cards[id] = card
+			ctx.renderCard(id)
+		}
+		// Appending a card already shown only moves it, keeping the cards sorted
+		dashboard.Call("appendChild", card.element)
+		card.element.Get("classList").Call("toggle", "selected", id == selected)
+	}
+}
+
+/*
+newCard - The card of a device, selecting the device when clicked.
+*/
+func (ctx *Ctx) newCard(id string) dashboardCard {
+
+	card := dashboardCard{
+		element: js.Global().Get("document").Call("createElement", "div"),
+		onClick: js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			ctx.selectCard(id)
+			return nil
+		}),
+	}
+	card.element.Set("className", "card")
+	card.element.Call("addEventListener", "click", card.onClick)
+
+	return card
+}
+
+/*
+renderCard - Redraw the card of one device after its status or presence changed.
+*/
+func (ctx *Ctx) renderCard(id string) {
+
+	card, ok := ctx.cards[id]
+	if !ok {
+		return
+	}
+	st := ctx.status(id)
+
+	lastSeen := ctx.devices[id].LastSeen
+	if st.lastSeen.After(lastSeen) {
+		lastSeen = st.lastSeen
+	}
+
+	deviceType := st.deviceType
+	if deviceType == "" {
+		deviceType = "unknown type"
+	}
+	state := st.state
+	if state == "" {
+		state = "no state reported"
+	}
+
+	alarms := make([]string, 0, len(st.alarms))
+	for _, alarm := range st.alarms {
+		alarms = append(alarms, alarm)
+	}
+	sort.Strings(alarms)
+	card.element.Get("classList").Call("toggle", "alarm", len(alarms) > 0)
+
+	lines := []string{
+		id,
+		deviceType,
+		"State: " + state,
+		"Last seen: " + lastSeen.Local().Format("15:04:05"),
+	}
+	if len(alarms) > 0 {
+		lines = append(lines, "Alarms: "+strings.Join(alarms, ", "))
+	} else {
+		lines = append(lines, "No alarm")
+	}
+	card.element.Set("innerText", strings.Join(lines, "\n"))
+}
+
+/*
+selectCard - Scope the control panels to the device of a dashboard card.
+*/
+func (ctx *Ctx) selectCard(id string) {
+
+	ctx.getElementByID("txtDispenserId").Set("value", id)
+	ctx.SelectDevice(js.Null(), nil)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall/js"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+/*
+EEPROM diff, compares the known EEPROM of the selected device with a file or the
+EEPROM of another device, and sends the differences picked to the selected device.
+*/
+
+const diffSourceFile = "file"
+
+/*
+eepromDiff - A field differing between the same entry of two reports. Field is nil
+when the entry is only in the source.
+*/
+type eepromDiff struct {
+	group  protoreflect.FieldDescriptor
+	idx    uint64
+	field  protoreflect.FieldDescriptor
+	target string
+	source string
+}
+
+func (d eepromDiff) String() string {
+
+	entry := strings.TrimSuffix(string(d.group.Name()), "_rpt") + " " + strconv.FormatUint(d.idx, 10)
+	if d.field == nil {
+		return entry
+	}
+	return entry + " " + string(d.field.Name())
+}
+
+/*
+eepromComparison - The last comparison made and the file loaded to compare with.
+*/
+type eepromComparison struct {
+	target   string
+	source   *kentpb.EepromReadReport
+	diffs    []eepromDiff
+	file     *kentpb.EepromReadReport
+	fileName string
+}
+
+/*
+diffReports - The fields of the entries of source that differ in target, entry by
+entry of every list of the report, ordered as in the report. The factory data is
+left out, it is not an EEPROM setting.
+*/
+func diffReports(target *kentpb.EepromReadReport, source *kentpb.EepromReadReport) []eepromDiff {
+
+	var diffs []eepromDiff
+
+	t := target.ProtoReflect()
+	s := source.ProtoReflect()
+	groups := t.Descriptor().Fields()
+	for i := 0; i < groups.Len(); i++ {
+		group := groups.Get(i)
+		if !group.IsList() || group.Message() == nil {
+			continue
+		}
+
+		targets := entriesByIdx(t.Get(group).List())
+		sources := entriesByIdx(s.Get(group).List())
+
+		idxs := make([]uint64, 0, len(sources))
+		for idx := range sources {
+			idxs = append(idxs, idx)
+		}
+		sort.Slice(idxs, func(i, j int) bool { return idxs[i] < idxs[j] })
+
+		for _, idx := range idxs {
+			src := sources[idx]
+			dst, ok := targets[idx]
+			if !ok {
+				diffs = append(diffs, eepromDiff{group: group, idx: idx, target: "not read", source: prototext.MarshalOptions{}.Format(src.Interface())})
+				continue
+			}
+
+			fields := group.Message().Fields()
+			for j := 0; j < fields.Len(); j++ {
+				fd := fields.Get(j)
+				if fd.Name() == "idx" {
+					continue
+				}
+				tv := formatField(fd, dst.Get(fd))
+				sv := formatField(fd, src.Get(fd))
+				if tv != sv {
+					diffs = append(diffs, eepromDiff{group: group, idx: idx, field: fd, target: tv, source: sv})
+				}
+			}
+		}
+	}
+
+	return diffs
+}
+
+/*
+entriesByIdx - The entries of a list of the report by their idx, entries without
+one are at their position in the list.
+*/
+func entriesByIdx(list protoreflect.List) map[uint64]protoreflect.Message {
+
+	entries := make(map[uint64]protoreflect.Message, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		m := list.Get(i).Message()
+		idx := uint64(i)
+		if fd := m.Descriptor().Fields().ByName("idx"); fd != nil {
+			idx = m.Get(fd).Uint()
+		}
+		entries[idx] = m
+	}
+	return entries
+}
+
+/*
+formatField - A field value as shown in the diff, enums by name.
+*/
+func formatField(fd protoreflect.FieldDescriptor, v protoreflect.Value) string {
+
+	if fd.IsList() {
+		values := make([]string, v.List().Len())
+		for i := range values {
+			values[i] = formatValue(fd, v.List().Get(i))
+		}
+		return "[" + strings.Join(values, ", ") + "]"
+	}
+	return formatValue(fd, v)
+}
+
+func formatValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) string {
+
+	switch fd.Kind() {
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return strconv.Itoa(int(v.Enum()))
+	case protoreflect.BytesKind:
+		return fmt.Sprintf("%X", v.Bytes())
+	case protoreflect.StringKind:
+		return strconv.Quote(v.String())
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return prototext.MarshalOptions{}.Format(v.Message().Interface())
+	}
+	return v.String()
+}
+
+/*
+diffRequests - The requests setting the fields of the diffs picked, from source, on
+the entries of target. An entry target doesn't have is sent whole.
+*/
+func diffRequests(target *kentpb.EepromReadReport, source *kentpb.EepromReadReport, picked []eepromDiff) []*kentpb.SrvToCli {
+
+	type entryKey struct {
+		group protoreflect.FullName
+		idx   uint64
+	}
+
+	t := target.ProtoReflect()
+	s := source.ProtoReflect()
+
+	rpt := &kentpb.EepromReadReport{}
+	entries := make(map[entryKey]protoreflect.Message)
+	for _, d := range picked {
+		src := entriesByIdx(s.Get(d.group).List())[d.idx]
+		if src == nil {
+			continue
+		}
+
+		key := entryKey{d.group.FullName(), d.idx}
+		entry, ok := entries[key]
+		if !ok {
+			if dst := entriesByIdx(t.Get(d.group).List())[d.idx]; dst != nil && d.field != nil {
+				entry = cloneEntry(dst)
+			} else {
+				entry = cloneEntry(src)
+			}
+			entries[key] = entry
+			rpt.ProtoReflect().Mutable(d.group).List().Append(protoreflect.ValueOfMessage(entry))
+		}
+
+		if d.field != nil {
+			entry.Set(d.field, src.Get(d.field))
+		}
+	}
+
+	return eepromRequests(rpt)
+}
+
+func cloneEntry(m protoreflect.Message) protoreflect.Message {
+	return proto.Clone(m.Interface()).ProtoReflect()
+}
+
+/*
+renderDiffSources - List the devices whose EEPROM is known, and the loaded file, as
+sources to compare the selected device with.
+*/
+func (ctx *Ctx) renderDiffSources() {
+
+	list := ctx.getElementByID("cmbDiffSource")
+	selected := list.Get("value").String()
+	list.Set("innerHTML", "")
+
+	document := js.Global().Get("document")
+	add := func(value string, text string) {
+		option := document.Call("createElement", "option")
+		option.Set("value", value)
+		option.Set("text", text)
+		list.Call("add", option)
+	}
+
+	if ctx.cmp.file != nil {
+		add(diffSourceFile, "File: "+ctx.cmp.fileName)
+	}
+
+	ids := make([]string, 0, len(ctx.eeprom))
+	for id, m := range ctx.eeprom {
+		if proto.Size(m.report()) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		add(id, "Device: "+id)
+	}
+
+	list.Set("value", selected)
+}
+
+/*
+EepromDiffFile - Load an EEPROM file, its content and name given by the file picker,
+to compare with.
+*/
+func (ctx *Ctx) EepromDiffFile(this js.Value, i []js.Value) interface{} {
+
+	if len(i) < 2 {
+		return 1
+	}
+
+	_, rpt, err := readEepromFile([]byte(i[0].String()))
+	if err != nil {
+		ctx.appendToLog("Loading " + i[1].String() + " failed: " + err.Error())
+		return 1
+	}
+
+	ctx.cmp.file = rpt
+	ctx.cmp.fileName = i[1].String()
+	ctx.renderDiffSources()
+	ctx.getElementByID("cmbDiffSource").Set("value", diffSourceFile)
+
+	return ctx.EepromDiff(this, i)
+}
+
+/*
+EepromDiff - Compare the known EEPROM of the selected device with the source picked.
+*/
+func (ctx *Ctx) EepromDiff(this js.Value, i []js.Value) interface{} {
+
+	target := ctx.getDispenserID()
+
+	var source *kentpb.EepromReadReport
+	switch name := ctx.getElementString("cmbDiffSource", "value"); name {
+	case "":
+		ctx.appendToLog("Nothing to compare with, read the EEPROM of another device or load a file")
+		return 1
+	case diffSourceFile:
+		source = ctx.cmp.file
+	default:
+		source = ctx.eepromOf(name).report()
+	}
+
+	ctx.cmp.target = target
+	ctx.cmp.source = source
+	ctx.cmp.diffs = diffReports(ctx.eepromOf(target).report(), source)
+	ctx.renderDiff()
+
+	return 1
+}
+
+/*
+renderDiff - Draw the differences of the last comparison, one checkbox each.
+*/
+func (ctx *Ctx) renderDiff() {
+
+	document := js.Global().Get("document")
+	area := ctx.getElementByID("divEepromDiff")
+	area.Set("innerHTML", "")
+
+	if len(ctx.cmp.diffs) == 0 {
+		area.Set("innerText", "No difference with "+ctx.cmp.target)
+		return
+	}
+
+	table := document.Call("createElement", "table")
+	header := table.Call("insertRow")
+	for _, title := range []string{"", "Setting", ctx.cmp.target, ctx.getElementByID("cmbDiffSource").Get("selectedOptions").Index(0).Get("text").String()} {
+		cell := document.Call("createElement", "th")
+		cell.Set("innerText", title)
+		header.Call("appendChild", cell)
+	}
+
+	for n, d := range ctx.cmp.diffs {
+		row := table.Call("insertRow")
+
+		check := document.Call("createElement", "input")
+		check.Set("type", "checkbox")
+		check.Set("id", "chkDiff"+strconv.Itoa(n))
+		row.Call("insertCell").Call("appendChild", check)
+
+		row.Call("insertCell").Set("innerText", d.String())
+		row.Call("insertCell").Set("innerText", d.target)
+		row.Call("insertCell").Set("innerText", d.source)
+	}
+
+	area.Call("appendChild", table)
+}
+
+/*
+EepromDiffSelectAll - Tick or untick every difference.
+*/
+func (ctx *Ctx) EepromDiffSelectAll(this js.Value, i []js.Value) interface{} {
+
+	checked := len(i) > 0 && i[0].Bool()
+	for n := range ctx.cmp.diffs {
+		ctx.getElementByID("chkDiff"+strconv.Itoa(n)).Set("checked", checked)
+	}
+	return 1
+}
+
+/*
+EepromDiffApply - Send the differences ticked to the device of the last comparison.
+They are not written to the EEPROM until Write is pressed, the comparison is redone
+as ws-kent acks them.
+*/
+func (ctx *Ctx) EepromDiffApply(this js.Value, i []js.Value) interface{} {
+
+	if !ctx.wsConn {
+		ctx.appendToLog("Not Connected to ws-kent!")
+		return 1
+	}
+
+	var picked []eepromDiff
+	for n, d := range ctx.cmp.diffs {
+		if ctx.getElementByID("chkDiff" + strconv.Itoa(n)).Get("checked").Bool() {
+			picked = append(picked, d)
+		}
+	}
+	if len(picked) == 0 {
+		ctx.appendToLog("No difference ticked")
+		return 1
+	}
+
+	target := ctx.cmp.target
+	reqs := diffRequests(ctx.eepromOf(target).report(), ctx.cmp.source, picked)
+
+	result := js.Global().Call("confirm", fmt.Sprintf("%d settings of %s will be changed but not written to the EEPROM. Are you sure you want to continue?", len(picked), target))
+	if result.String() != "<boolean: true>" {
+		return 1
+	}
+
+	for _, req := range reqs {
+		ctx.sendToWs(target, req)
+	}
+	ctx.appendToLog(fmt.Sprintf("%d settings sent to %s, press Write to save them in the EEPROM", len(picked), target))
+
+	return 1
+}
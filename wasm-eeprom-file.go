@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall/js"
+	"time"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+EEPROM files, the protojson of a device's EepromRRpt with what it was exported from:
+
+	{
+		"schemaVersion": 2,
+		"deviceId": "<id>",
+		"deviceType": "DT_FRYER_PORTIONING",
+		"hwRev": 1,
+		"exportedAt": "2024-05-01T12:00:00Z",
+		"eeprom": {"stepperRpt": [...], ...}
+	}
+
+Schema versions:
+
+	1  The protobuf text of the CliToSrv, exported before the JSON files
+	2  The JSON above
+*/
+
+const eepromFileVersion = 2
+
+type eepromFile struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	DeviceID      string          `json:"deviceId"`
+	DeviceType    string          `json:"deviceType"`
+	HwRev         uint32          `json:"hwRev"`
+	ExportedAt    time.Time       `json:"exportedAt"`
+	Eeprom        json.RawMessage `json:"eeprom"`
+}
+
+/*
+report - The entries of the model as an EEPROM read report.
+*/
+func (m *eepromModel) report() *kentpb.EepromReadReport {
+
+	rpt := &kentpb.EepromReadReport{FactoryRpt: m.factory}
+	for _, e := range m.steppers {
+		if e != nil {
+			rpt.StepperRpt = append(rpt.StepperRpt, e)
+		}
+	}
+	for _, e := range m.pids {
+		if e != nil {
+			rpt.PidRpt = append(rpt.PidRpt, e)
+		}
+	}
+	for _, e := range m.scales {
+		if e != nil {
+			rpt.ScaleRpt = append(rpt.ScaleRpt, e)
+		}
+	}
+	for _, e := range m.dcMotors {
+		if e != nil {
+			rpt.DcmotRpt = append(rpt.DcmotRpt, e)
+		}
+	}
+	for _, e := range m.masses {
+		if e != nil {
+			rpt.MassRpt = append(rpt.MassRpt, e)
+		}
+	}
+	for _, e := range m.temperatures {
+		if e != nil {
+			rpt.TemperatureRpt = append(rpt.TemperatureRpt, e)
+		}
+	}
+	for _, e := range m.ingredients {
+		if e != nil {
+			rpt.IngredientRpt = append(rpt.IngredientRpt, e)
+		}
+	}
+	for _, e := range m.transports {
+		if e != nil {
+			rpt.TransportRpt = append(rpt.TransportRpt, e)
+		}
+	}
+
+	return rpt
+}
+
+/*
+eepromRequests - The requests setting every entry of a report but the factory data,
+which identifies the device and is only changed from the Factory panel.
+*/
+func eepromRequests(rpt *kentpb.EepromReadReport) []*kentpb.SrvToCli {
+
+	var reqs []*kentpb.SrvToCli
+	add := func(oneof interface{}) {
+		req := &kentpb.SrvToCli{}
+		switch r := oneof.(type) {
+		case *kentpb.EepromScaleData:
+			req.ReqOneof = &kentpb.SrvToCli_EepromScaleReq{r}
+		case *kentpb.EepromStepperData:
+			req.ReqOneof = &kentpb.SrvToCli_EepromStepperReq{r}
+		case *kentpb.EepromDcMotorData:
+			req.ReqOneof = &kentpb.SrvToCli_EepromDcmotorReq{r}
+		case *kentpb.EepromPidData:
+			req.ReqOneof = &kentpb.SrvToCli_EepromPidReq{r}
+		case *kentpb.DispenserEepromMassData:
+			req.ReqOneof = &kentpb.SrvToCli_DispenserEepromMassReq{r}
+		case *kentpb.EepromTemperatureControlData:
+			req.ReqOneof = &kentpb.SrvToCli_EepromTemperatureReq{r}
+		case *kentpb.EepromIngredientData:
+			req.ReqOneof = &kentpb.SrvToCli_EepromIngredientReq{r}
+		case *kentpb.EepromPositionsRequest:
+			req.ReqOneof = &kentpb.SrvToCli_FryerEepromPositionsReq{r}
+		}
+		reqs = append(reqs, req)
+	}
+
+	for _, e := range rpt.GetScaleRpt() {
+		add(e)
+	}
+	for _, e := range rpt.GetStepperRpt() {
+		add(e)
+	}
+	for _, e := range rpt.GetDcmotRpt() {
+		add(e)
+	}
+	for _, e := range rpt.GetPidRpt() {
+		add(e)
+	}
+	for _, e := range rpt.GetMassRpt() {
+		add(e)
+	}
+	for _, e := range rpt.GetTemperatureRpt() {
+		add(e)
+	}
+	for _, e := range rpt.GetIngredientRpt() {
+		add(e)
+	}
+	for _, e := range rpt.GetTransportRpt() {
+		add(e)
+	}
+
+	return reqs
+}
+
+/*
+newEepromFile - The current schema file of a device's EEPROM model.
+*/
+func newEepromFile(id string, m *eepromModel) (*eepromFile, error) {
+
+	b, err := protojson.Marshal(m.report())
+	if err != nil {
+		return nil, err
+	}
+
+	f := &eepromFile{
+		SchemaVersion: eepromFileVersion,
+		DeviceID:      id,
+		ExportedAt:    time.Now().UTC(),
+		Eeprom:        b,
+	}
+	if m.factory != nil {
+		f.DeviceType = m.factory.GetDeviceType().String()
+		f.HwRev = m.factory.GetHwRev()
+	}
+
+	return f, nil
+}
+
+/*
+readEepromFile - Parse an EEPROM file of any schema version and the report it holds.
+Older files are migrated, SchemaVersion stays the one they were exported with.
+*/
+func readEepromFile(data []byte) (*eepromFile, *kentpb.EepromReadReport, error) {
+
+	data = bytes.TrimSpace(data)
+
+	var f *eepromFile
+	if !bytes.HasPrefix(data, []byte("{")) {
+		var err error
+		if f, err = migrateEepromFileV1(data); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		f = &eepromFile{}
+		if err := json.Unmarshal(data, f); err != nil {
+			return nil, nil, fmt.Errorf("not an EEPROM file: %w", err)
+		}
+	}
+
+	switch {
+	case f.SchemaVersion == 0 || len(f.Eeprom) == 0:
+		return nil, nil, errors.New("not an EEPROM file")
+	case f.SchemaVersion > eepromFileVersion:
+		return nil, nil, fmt.Errorf("schema version %d is newer than this UI supports (%d), update the UI", f.SchemaVersion, eepromFileVersion)
+	}
+
+	// Entries added by newer firmware are dropped rather than refused
+	rpt := &kentpb.EepromReadReport{}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(f.Eeprom, rpt); err != nil {
+		return nil, nil, fmt.Errorf("decoding EEPROM: %w", err)
+	}
+
+	return f, rpt, nil
+}
+
+/*
+migrateEepromFileV1 - Convert a schema 1 file, the protobuf text of the CliToSrv
+holding the EepromRRpt, its metadata taken from the factory data. It has no export
+time.
+*/
+func migrateEepromFileV1(data []byte) (*eepromFile, error) {
+
+	msg := &kentpb.CliToSrv{}
+	if err := (prototext.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("not an EEPROM file: %w", err)
+	}
+	if msg.GetEepromRRpt() == nil {
+		return nil, errors.New("not an EEPROM file: no EepromRRpt")
+	}
+
+	b, err := protojson.Marshal(msg.GetEepromRRpt())
+	if err != nil {
+		return nil, err
+	}
+
+	f := &eepromFile{
+		SchemaVersion: 1,
+		Eeprom:        b,
+	}
+	if factory := msg.GetEepromRRpt().GetFactoryRpt(); factory != nil {
+		f.DeviceID = factory.GetId()
+		f.DeviceType = factory.GetDeviceType().String()
+		f.HwRev = factory.GetHwRev()
+	}
+
+	return f, nil
+}
+
+/*
+compatibility - What differs between the device a file was exported from and the
+device it is imported to, empty when they match.
+*/
+func (f *eepromFile) compatibility(id string, m *eepromModel) []string {
+
+	if m.factory == nil {
+		return []string{"the EEPROM of " + id + " has not been read, its type can't be checked"}
+	}
+
+	var warnings []string
+	if f.DeviceType != "" && f.DeviceType != m.factory.GetDeviceType().String() {
+		warnings = append(warnings, "the file is for a "+f.DeviceType+", the device is a "+m.factory.GetDeviceType().String())
+	}
+	if f.HwRev != 0 && f.HwRev != m.factory.GetHwRev() {
+		warnings = append(warnings, fmt.Sprintf("the file is for HW rev %d, the device is HW rev %d", f.HwRev, m.factory.GetHwRev()))
+	}
+
+	return warnings
+}
+
+/*
+EepromExport - Download the EEPROM model of the selected device as a JSON file.
+*/
+func (ctx *Ctx) EepromExport(this js.Value, i []js.Value) interface{} {
+
+	id := ctx.getDispenserID()
+	m := ctx.eepromOf(id)
+	if proto.Size(m.report()) == 0 {
+		ctx.appendToLog("Nothing to export, read the EEPROM of " + id + " first")
+		return 1
+	}
+
+	f, err := newEepromFile(id, m)
+	if err != nil {
+		ctx.appendToLog("Export failed: " + err.Error())
+		return 1
+	}
+	b, err := json.MarshalIndent(f, "", "\t")
+	if err != nil {
+		ctx.appendToLog("Export failed: " + err.Error())
+		return 1
+	}
+
+	blob := js.Global().Get("Blob").New([]interface{}{string(b)}, map[string]interface{}{"type": "application/json"})
+	url := js.Global().Get("URL").Call("createObjectURL", blob)
+
+	a := js.Global().Get("document").Call("createElement", "a")
+	a.Set("href", url)
+	a.Set("download", id+"_EEPROM_"+f.ExportedAt.Format("20060102-150405")+".json")
+	js.Global().Get("document").Get("body").Call("appendChild", a)
+	a.Call("click")
+	js.Global().Get("document").Get("body").Call("removeChild", a)
+	js.Global().Get("URL").Call("revokeObjectURL", url)
+
+	ctx.appendToLog("EEPROM of " + id + " exported")
+	return 1
+}
+
+/*
+EepromImport - Send the settings of an EEPROM file, its content and name given by
+the file picker, to the selected device. They are not written to the EEPROM until
+Write is pressed.
+*/
+func (ctx *Ctx) EepromImport(this js.Value, i []js.Value) interface{} {
+
+	if len(i) < 2 {
+		return 1
+	}
+	name := i[1].String()
+
+	if !ctx.wsConn {
+		ctx.appendToLog("Not Connected to ws-kent!")
+		return 1
+	}
+
+	f, rpt, err := readEepromFile([]byte(i[0].String()))
+	if err != nil {
+		ctx.appendToLog("Import of " + name + " failed: " + err.Error())
+		return 1
+	}
+
+	id := ctx.getDispenserID()
+	question := "All previous dispenser data will be overwritten by the settings of " + name + " but will not be written to the EEPROM."
+	if warnings := f.compatibility(id, ctx.eepromOf(id)); len(warnings) > 0 {
+		question += "\n\nWARNING: " + strings.Join(warnings, "\nWARNING: ")
+	}
+	result := js.Global().Call("confirm", question+"\n\nAre you sure you want to continue?")
+	if result.String() != "<boolean: true>" {
+		return 1
+	}
+
+	// Entries past the indices of the UI are dropped on the way through a model
+	imported := &eepromModel{}
+	imported.update(rpt)
+	for _, req := range eepromRequests(imported.report()) {
+		ctx.sendToWs(id, req)
+	}
+
+	ctx.appendToLog(fmt.Sprintf("Imported %s (schema %d, exported from %s)", name, f.SchemaVersion, f.DeviceID))
+	return 1
+}
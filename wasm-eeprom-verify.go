@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"syscall/js"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+Verified EEPROM writes, the settings sent to a device since its last write are
+compared with what the device reads back once EepromWReq is delivered.
+*/
+
+/*
+eepromVerification - A write waiting to be read back.
+*/
+type eepromVerification struct {
+	writeReqID string
+	readReqID  string
+	expected   *eepromModel
+}
+
+/*
+recordWrite - Keep an EEPROM setting sent to a device, to verify it once written.
+*/
+func (ctx *Ctx) recordWrite(id string, req *kentpb.SrvToCli) {
+
+	m, ok := ctx.written[id]
+	if !ok {
+		m = &eepromModel{}
+		ctx.written[id] = m
+	}
+	m.apply(req)
+}
+
+/*
+verifyWrite - Verify the write sent as reqID with the settings recorded for the
+device until now.
+*/
+func (ctx *Ctx) verifyWrite(id string, reqID string) {
+
+	expected, ok := ctx.written[id]
+	if !ok {
+		expected = &eepromModel{}
+	}
+	delete(ctx.written, id)
+
+	ctx.verify[id] = &eepromVerification{
+		writeReqID: reqID,
+		expected:   expected,
+	}
+}
+
+/*
+verifyReply - Follow a write being verified through the replies of ws-kent: read
+the EEPROM back once the write is delivered, then check the read answering it. A
+write or read back that fails or times out fails the verification.
+*/
+func (ctx *Ctx) verifyReply(payload jsonData) {
+
+	v, ok := ctx.verify[payload.ID]
+	if !ok || payload.ReqID == "" {
+		return
+	}
+
+	switch payload.ReqID {
+	case v.writeReqID:
+		if payload.Type != wsMsgAck {
+			return
+		}
+		if payload.Error != "" {
+			ctx.failWrite(payload.ID, "the write failed: "+payload.Error)
+			return
+		}
+
+		req := &kentpb.SrvToCli{
+			ReqOneof: &kentpb.SrvToCli_EepromRReq{},
+		}
+		v.readReqID = ctx.sendToWs(payload.ID, req)
+	case v.readReqID:
+		switch {
+		case payload.Error != "":
+			ctx.failWrite(payload.ID, "reading it back failed: "+payload.Error)
+		case payload.Type == wsMsgTimeout:
+			ctx.failWrite(payload.ID, "the device didn't answer reading it back")
+		case payload.Type == wsMsgResponse:
+			b, err := base64.StdEncoding.DecodeString(payload.Binary)
+			rpt := &kentpb.CliToSrv{}
+			if err == nil {
+				err = proto.Unmarshal(b, rpt)
+			}
+			if err != nil || rpt.GetEepromRRpt() == nil {
+				ctx.failWrite(payload.ID, "reading it back didn't return the EEPROM")
+				return
+			}
+			ctx.checkWrite(payload.ID, rpt.GetEepromRRpt())
+		}
+	}
+}
+
+/*
+checkWrite - Compare the EEPROM read back from a device with the write being
+verified, and report the settings that didn't stick.
+*/
+func (ctx *Ctx) checkWrite(id string, rpt *kentpb.EepromReadReport) {
+
+	v := ctx.verify[id]
+	delete(ctx.verify, id)
+
+	var mismatches []string
+	if f := v.expected.factory; f != nil && !proto.Equal(f, rpt.GetFactoryRpt()) {
+		mismatches = append(mismatches, "factory: sent "+prototext.Format(f)+", read "+prototext.Format(rpt.GetFactoryRpt()))
+	}
+	for _, d := range diffReports(rpt, v.expected.report()) {
+		mismatches = append(mismatches, d.String()+": sent "+d.source+", read "+d.target)
+	}
+
+	if len(mismatches) == 0 {
+		ctx.appendToLog("EEPROM write to " + id + " verified")
+		return
+	}
+
+	ctx.failWrite(id, strings.Join(mismatches, "; "))
+}
+
+/*
+failWrite - Report a write that failed verification and stop verifying it.
+*/
+func (ctx *Ctx) failWrite(id string, reason string) {
+
+	delete(ctx.verify, id)
+
+	msg := "EEPROM write to " + id + " FAILED verification, " + reason
+	ctx.appendToLog(msg)
+	js.Global().Call("alert", msg)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"syscall/js"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+	"google.golang.org/protobuf/proto"
+)
+
+// Only the first ingredient is exposed by the firmware.
+const NB_OF_INGREDIENTS = 1
+
+/*
+eepromModel - The EEPROM of a device as last read from it or set by a request
+ws-kent delivered to it, every entry by its idx. Entries never read are nil. A
+delivered setting may still have been refused by the device, only reading the
+EEPROM back tells.
+*/
+type eepromModel struct {
+	factory      *kentpb.EepromFactoryData
+	steppers     [NB_OF_STEPPERS]*kentpb.EepromStepperData
+	pids         [NB_OF_PID_SETTINGS]*kentpb.EepromPidData
+	scales       [NB_OF_SCALES]*kentpb.EepromScaleData
+	dcMotors     [NB_OF_DC_MOTORS]*kentpb.EepromDcMotorData
+	masses       [NB_OF_MASS_SETTINGS]*kentpb.DispenserEepromMassData
+	temperatures [NB_OF_TEMP_CONTROLLERS]*kentpb.EepromTemperatureControlData
+	ingredients  [NB_OF_INGREDIENTS]*kentpb.EepromIngredientData
+	transports   [NB_OF_TRANSPORTS]*kentpb.EepromPositionsRequest
+}
+
+/*
+eepromOf - The EEPROM model of a device, created empty on first use.
+*/
+func (ctx *Ctx) eepromOf(id string) *eepromModel {
+
+	m, ok := ctx.eeprom[id]
+	if !ok {
+		m = &eepromModel{}
+		ctx.eeprom[id] = m
+	}
+	return m
+}
+
+/*
+eepromSent - An EEPROM setting sent to a device, waiting for ws-kent to ack it.
+*/
+type eepromSent struct {
+	id  string
+	req *kentpb.SrvToCli
+}
+
+/*
+sentEeprom - Remember a request sent to a device until it is acked when it sets
+an EEPROM entry, other requests are not kept.
+*/
+func (ctx *Ctx) sentEeprom(id string, reqID string, req *kentpb.SrvToCli) {
+
+	if eepromSetting(req) != nil {
+		ctx.unacked[reqID] = eepromSent{id: id, req: req}
+	}
+}
+
+/*
+dropUnacked - Forget the EEPROM settings sent to a device that will never be acked,
+to every device when id is empty.
+*/
+func (ctx *Ctx) dropUnacked(id string) {
+
+	for reqID, sent := range ctx.unacked {
+		if id == "" || sent.id == id {
+			delete(ctx.unacked, reqID)
+		}
+	}
+}
+
+/*
+eepromAcked - Store the EEPROM setting of a request in the model of the device once
+ws-kent acked it as delivered, and redraw the EEPROM panels showing it. A setting
+that failed to be delivered or timed out is dropped.
+*/
+func (ctx *Ctx) eepromAcked(payload jsonData) {
+
+	sent, ok := ctx.unacked[payload.ReqID]
+	if !ok {
+		return
+	}
+	delete(ctx.unacked, payload.ReqID)
+
+	if payload.Type != wsMsgAck || payload.Error != "" {
+		return
+	}
+
+	ctx.eepromOf(sent.id).apply(sent.req)
+	if sent.id == ctx.getDispenserID() {
+		ctx.renderEeprom()
+	}
+	if sent.id == ctx.cmp.target && ctx.cmp.source != nil {
+		ctx.cmp.diffs = diffReports(ctx.eepromOf(sent.id).report(), ctx.cmp.source)
+		ctx.renderDiff()
+	}
+}
+
+/*
+update - Store the entries of an EEPROM read report, the ones it doesn't carry
+are kept.
+*/
+func (m *eepromModel) update(rpt *kentpb.EepromReadReport) {
+
+	if rpt.GetFactoryRpt() != nil {
+		m.factory = proto.Clone(rpt.GetFactoryRpt()).(*kentpb.EepromFactoryData)
+	}
+	for _, e := range rpt.GetStepperRpt() {
+		if e.GetIdx() < NB_OF_STEPPERS {
+			m.steppers[e.GetIdx()] = proto.Clone(e).(*kentpb.EepromStepperData)
+		}
+	}
+	for _, e := range rpt.GetPidRpt() {
+		if e.GetIdx() < NB_OF_PID_SETTINGS {
+			m.pids[e.GetIdx()] = proto.Clone(e).(*kentpb.EepromPidData)
+		}
+	}
+	for _, e := range rpt.GetScaleRpt() {
+		if e.GetIdx() < NB_OF_SCALES {
+			m.scales[e.GetIdx()] = proto.Clone(e).(*kentpb.EepromScaleData)
+		}
+	}
+	for _, e := range rpt.GetDcmotRpt() {
+		if e.GetIdx() < NB_OF_DC_MOTORS {
+			m.dcMotors[e.GetIdx()] = proto.Clone(e).(*kentpb.EepromDcMotorData)
+		}
+	}
+	for _, e := range rpt.GetMassRpt() {
+		if e.GetIdx() < NB_OF_MASS_SETTINGS {
+			m.masses[e.GetIdx()] = proto.Clone(e).(*kentpb.DispenserEepromMassData)
+		}
+	}
+	for _, e := range rpt.GetTemperatureRpt() {
+		if e.GetIdx() < NB_OF_TEMP_CONTROLLERS {
+			m.temperatures[e.GetIdx()] = proto.Clone(e).(*kentpb.EepromTemperatureControlData)
+		}
+	}
+	for _, e := range rpt.GetIngredientRpt() {
+		if e.GetIdx() < NB_OF_INGREDIENTS {
+			m.ingredients[e.GetIdx()] = proto.Clone(e).(*kentpb.EepromIngredientData)
+		}
+	}
+	for _, e := range rpt.GetTransportRpt() {
+		if e.GetIdx() < NB_OF_TRANSPORTS {
+			m.transports[e.GetIdx()] = proto.Clone(e).(*kentpb.EepromPositionsRequest)
+		}
+	}
+}
+
+/*
+eepromSetting - The entry set by an EEPROM request, as a read report carrying only
+it, nil for other requests.
+*/
+func eepromSetting(req *kentpb.SrvToCli) *kentpb.EepromReadReport {
+
+	rpt := &kentpb.EepromReadReport{}
+
+	switch r := req.GetReqOneof().(type) {
+	case *kentpb.SrvToCli_EepromFactoryReq:
+		rpt.FactoryRpt = r.EepromFactoryReq
+	case *kentpb.SrvToCli_EepromStepperReq:
+		rpt.StepperRpt = []*kentpb.EepromStepperData{r.EepromStepperReq}
+	case *kentpb.SrvToCli_EepromPidReq:
+		rpt.PidRpt = []*kentpb.EepromPidData{r.EepromPidReq}
+	case *kentpb.SrvToCli_EepromScaleReq:
+		rpt.ScaleRpt = []*kentpb.EepromScaleData{r.EepromScaleReq}
+	case *kentpb.SrvToCli_EepromDcmotorReq:
+		rpt.DcmotRpt = []*kentpb.EepromDcMotorData{r.EepromDcmotorReq}
+	case *kentpb.SrvToCli_DispenserEepromMassReq:
+		rpt.MassRpt = []*kentpb.DispenserEepromMassData{r.DispenserEepromMassReq}
+	case *kentpb.SrvToCli_EepromTemperatureReq:
+		rpt.TemperatureRpt = []*kentpb.EepromTemperatureControlData{r.EepromTemperatureReq}
+	case *kentpb.SrvToCli_EepromIngredientReq:
+		rpt.IngredientRpt = []*kentpb.EepromIngredientData{r.EepromIngredientReq}
+	case *kentpb.SrvToCli_FryerEepromPositionsReq:
+		rpt.TransportRpt = []*kentpb.EepromPositionsRequest{r.FryerEepromPositionsReq}
+	default:
+		return nil
+	}
+
+	return rpt
+}
+
+/*
+apply - Store the entry set by an EEPROM request sent to the device, other
+requests are ignored.
+*/
+func (m *eepromModel) apply(req *kentpb.SrvToCli) {
+
+	if rpt := eepromSetting(req); rpt != nil {
+		m.update(rpt)
+	}
+}
+
+/*
+selectedIdx - The index typed in an index field, false when it is out of range.
+*/
+func (ctx *Ctx) selectedIdx(elem string, n int) (int, bool) {
+
+	idx, err := strconv.ParseUint(ctx.getElementString(elem, "value"), 10, 32)
+	if err != nil || idx >= uint64(n) {
+		return 0, false
+	}
+	return int(idx), true
+}
+
+/*
+renderEeprom - Fill the EEPROM fields of every panel from the model of the selected
+device, at the index each panel shows. Fields of entries never read are left as
+they are.
+*/
+func (ctx *Ctx) renderEeprom() {
+
+	m := ctx.eepromOf(ctx.getDispenserID())
+
+	if f := m.factory; f != nil {
+		ctx.getElementByID("txtFactoryDispenserId").Set("value", f.GetId())
+		if mac := f.GetMac(); len(mac) == 6 {
+			ctx.getElementByID("txtFactoryMac").Set("value", fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", mac[0], mac[1], mac[2], mac[3], mac[4], mac[5]))
+		}
+		ctx.getElementByID("cmbFactoryType").Set("value", int(f.GetDeviceType()))
+		ctx.getElementByID("txtFactoryHwRev").Set("value", f.GetHwRev())
+	}
+
+	if idx, ok := ctx.selectedIdx("txtStepperIdx", NB_OF_STEPPERS); ok && m.steppers[idx] != nil {
+		s := m.steppers[idx]
+		ctx.getElementByID("txtStepperDir").Set("value", s.GetDirection())
+		ctx.getElementByID("txtStepperSpeedRps").Set("value", float64(s.GetFSpeedMaxRps())/1000)
+		ctx.getElementByID("txtStepperAccelRps").Set("value", float64(s.GetFAccelRpss())/1000)
+		ctx.getElementByID("txtStepperDecelRps").Set("value", float64(s.GetFDecelRpss())/1000)
+		ctx.getElementByID("txtStepperHomeSpeedRps").Set("value", float64(s.GetFHomeSpeedRps())/1000)
+		ctx.getElementByID("txtStepperHomeAccelRps").Set("value", float64(s.GetFHomeAccelRpss())/1000)
+		ctx.getElementByID("txtStepperMaxCurrent").Set("value", s.GetCurrentMax())
+		ctx.getElementByID("txtStepperMinCurrent").Set("value", s.GetCurrentMin())
+		ctx.getElementByID("txtStepperHoldCurrent").Set("value", s.GetHoldCurrent())
+		ctx.getElementByID("txtStepperRetreatSpeed").Set("value", s.GetRetreatSpeedPct())
+		ctx.getElementByID("txtStepperRetreatAngle").Set("value", s.GetRetreatAngle())
+	}
+
+	if idx, ok := ctx.selectedIdx("txtPidIdx", NB_OF_PID_SETTINGS); ok && m.pids[idx] != nil {
+		p := m.pids[idx]
+		ctx.getElementByID("txtDispenseKp").Set("value", float64(p.GetFKp())/1000)
+		ctx.getElementByID("txtDispenseKi").Set("value", float64(p.GetFKi())/1000)
+		ctx.getElementByID("txtDispenseKd").Set("value", float64(p.GetFKd())/1000)
+		ctx.getElementByID("txtDispenseSaturMax").Set("value", p.GetSaturMax())
+		ctx.getElementByID("txtDispenseSaturMin").Set("value", p.GetSaturMin())
+		ctx.getElementByID("txtDispensePidOffset").Set("value", p.GetOffset())
+		ctx.getElementByID("txtDispenseSamplingT").Set("value", p.GetSamplingTimeMs())
+	}
+
+	if idx, ok := ctx.selectedIdx("txtScaleIdx", NB_OF_SCALES); ok && m.scales[idx] != nil {
+		s := m.scales[idx]
+		ctx.getElementByID("txtScaleReadingSamples").Set("value", s.GetReadingSamples())
+		ctx.getElementByID("txtScaleCalibrWeight").Set("value", s.GetCalibWeightG())
+		ctx.getElementByID("txtScaleCalibrWSampl").Set("value", s.GetFullCalibSamples())
+		ctx.getElementByID("txtScaleTareSampl").Set("value", s.GetTareSamples())
+		ctx.getElementByID("txtScaleCalibrZeroSampl").Set("value", s.GetZeroCalibSamples())
+		ctx.getElementByID("txtScaleTrayWeight").Set("value", s.GetTrayWeightG())
+	}
+
+	if idx, ok := ctx.selectedIdx("txtDcMotorIdx", NB_OF_DC_MOTORS); ok && m.dcMotors[idx] != nil {
+		d := m.dcMotors[idx]
+		ctx.getElementByID("txtDcMotorSpeedPerc").Set("value", d.GetSpeedPct())
+		ctx.getElementByID("txtDcMotorDir").Set("value", d.GetDirection())
+		ctx.getElementByID("txtDcMotorRetreatSpeed").Set("value", d.GetRetreatSpeedPct())
+		ctx.getElementByID("txtDcMotorRetreatTime").Set("value", d.GetRetreatTimeMs())
+	}
+
+	if idx, ok := ctx.selectedIdx("txtDispenseMassIdx", NB_OF_MASS_SETTINGS); ok && m.masses[idx] != nil {
+		ctx.getElementByID("txtMassRunsMax").Set("value", m.masses[idx].GetRunMax())
+		ctx.getElementByID("txtMassDispenseTimeout").Set("value", m.masses[idx].GetDispensingTimeoutMs())
+	}
+
+	if idx, ok := ctx.selectedIdx("txtTemperatureControlIdx", NB_OF_TEMP_CONTROLLERS); ok && m.temperatures[idx] != nil {
+		t := m.temperatures[idx]
+		ctx.getElementByID("txtTemperatureControlSetPoint").Set("value", t.GetFTemperatureC())
+		ctx.getElementByID("txtTemperatureControlTolerance").Set("value", t.GetFToleranceC())
+		ctx.getElementByID("cmbTemperatureControlMode").Set("value", uint32(t.GetMode()))
+	}
+
+	if i := m.ingredients[0]; i != nil {
+		ctx.getElementByID("txtIngredientName").Set("value", i.GetIngredient())
+	}
+
+	if idx, ok := ctx.selectedIdx("txtTransportIdx", NB_OF_TRANSPORTS); ok && m.transports[idx] != nil {
+		t := m.transports[idx]
+		for pos, micro := range t.GetPosition() {
+			if pos >= NB_OF_HANDOVER_POS {
+				break
+			}
+			ctx.getElementByID("txtPosition"+strconv.Itoa(pos)+"Micro").Set("value", micro)
+		}
+		ctx.getElementByID("txtToleranceMicro").Set("value", t.GetTolerance())
+	}
+}
+
+/*
+ShowEepromParams - Show the values of the index just picked in a panel, without
+reading the EEPROM again.
+*/
+func (ctx *Ctx) ShowEepromParams(this js.Value, i []js.Value) interface{} {
+	ctx.renderEeprom()
+	return 1
+}
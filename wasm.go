@@ -4,7 +4,10 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
 	"syscall/js"
 	"time"
 
@@ -27,13 +30,50 @@ const (
 Ctx - Context
 */
 type Ctx struct {
-	wsSrv  js.Value
-	wsConn bool
+	wsSrv      js.Value
+	wsConn     bool
+	devices    map[string]deviceData
+	fleet      map[string]*deviceStatus
+	cards      map[string]dashboardCard
+	subscribed string
+	eeprom     map[string]*eepromModel
+	cmp        eepromComparison
+	written    map[string]*eepromModel
+	verify     map[string]*eepromVerification
+	reqSeq     int
+	pending    map[string]string
+	unacked    map[string]eepromSent
 }
 
 type jsonData struct {
-	ID     string `json:"id"`
-	Binary string `json:"binary"`
+	Type     string       `json:"type,omitempty"`
+	ID       string       `json:"id"`
+	ReqID    string       `json:"reqId,omitempty"`
+	Binary   string       `json:"binary,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	Awaiting string       `json:"awaiting,omitempty"`
+	Queue    int          `json:"queue,omitempty"`
+	Devices  []string     `json:"devices,omitempty"`
+	Reports  []string     `json:"reports,omitempty"`
+	Presence []deviceData `json:"presence,omitempty"`
+	CachedAt *time.Time   `json:"cachedAt,omitempty"`
+}
+
+const (
+	wsMsgSubscribe = "subscribe"
+	wsMsgPresence  = "presence"
+	wsMsgDevices   = "devices"
+	wsMsgAck       = "ack"
+	wsMsgResponse  = "response"
+	wsMsgTimeout   = "timeout"
+)
+
+type deviceData struct {
+	ID          string    `json:"id"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	LastSeen    time.Time `json:"lastSeen"`
+	Online      bool      `json:"online"`
 }
 
 type scaleData struct {
@@ -107,21 +147,82 @@ func (ctx *Ctx) getDispenserID() string {
 	return dispenserID
 }
 
-func (ctx *Ctx) sendToWs(id string, data *kentpb.SrvToCli) {
+func (ctx *Ctx) sendToWs(id string, data *kentpb.SrvToCli) string {
 
 	b, err := proto.Marshal(data)
 	if err != nil {
 		fmt.Println("Error marshaling", err)
 	}
 
+	ctx.reqSeq++
+	reqID := strconv.Itoa(ctx.reqSeq)
+	ctx.pending[reqID] = strings.TrimPrefix(fmt.Sprintf("%T", data.GetReqOneof()), "*kentpb.SrvToCli_")
+
 	var payload jsonData
 	payload.ID = id
+	payload.ReqID = reqID
 	payload.Binary = base64.StdEncoding.EncodeToString([]byte(b))
 
 	p, _ := json.Marshal(payload)
 	ctx.wsSrv.Call("send", string(p))
 	ctx.appendToLog(data.String())
 
+	ctx.sentEeprom(id, reqID, data)
+	ctx.recordWrite(id, data)
+
+	return reqID
+}
+
+/*
+handleReply - Report the outcome of a request sent with sendToWs. Requests ws-kent
+is awaiting a report for stay pending until the report or a timeout arrives.
+*/
+func (ctx *Ctx) handleReply(payload jsonData) {
+
+	ctx.eepromAcked(payload)
+	ctx.verifyReply(payload)
+
+	if payload.Type == wsMsgAck && payload.ID == ctx.getDispenserID() {
+		ctx.getElementByID("lblQueueDepth").Set("innerText", payload.Queue)
+	}
+
+	name, ok := ctx.pending[payload.ReqID]
+	if !ok {
+		return
+	}
+
+	switch {
+	case payload.Error != "":
+		delete(ctx.pending, payload.ReqID)
+		ctx.appendToLog(name + " to " + payload.ID + " failed: " + payload.Error)
+	case payload.Type == wsMsgResponse:
+		delete(ctx.pending, payload.ReqID)
+		ctx.appendToLog(name + " answered by " + payload.ID)
+	case payload.Awaiting != "":
+		ctx.appendToLog(name + " delivered to " + payload.ID + ", awaiting " + payload.Awaiting)
+	default:
+		delete(ctx.pending, payload.ReqID)
+		ctx.appendToLog(name + " delivered to " + payload.ID)
+	}
+}
+
+/*
+subscribeSelected - Get every report of the selected device and the dashboard
+reports of the others.
+*/
+func (ctx *Ctx) subscribeSelected() {
+
+	payload := jsonData{
+		Type:    wsMsgSubscribe,
+		Reports: dashboardReports,
+	}
+	ctx.subscribed = ctx.getDispenserID()
+	if ctx.subscribed != "" {
+		payload.Devices = []string{ctx.subscribed}
+	}
+
+	p, _ := json.Marshal(payload)
+	ctx.wsSrv.Call("send", string(p))
 }
 
 func (ctx *Ctx) receiveFromWs(msg js.Value) {
@@ -134,6 +235,21 @@ func (ctx *Ctx) receiveFromWs(msg js.Value) {
 		return
 	}
 
+	switch payload.Type {
+	case wsMsgPresence:
+		ctx.updatePresence(payload.Presence)
+		return
+	case wsMsgDevices:
+		ctx.devices = make(map[string]deviceData)
+		ctx.fleet = make(map[string]*deviceStatus)
+		ctx.updatePresence(payload.Presence)
+		return
+	case wsMsgAck, wsMsgResponse, wsMsgTimeout:
+		// responses are also delivered as regular reports to subscribed clients
+		ctx.handleReply(payload)
+		return
+	}
+
 	//decode binary
 	b, err := base64.StdEncoding.DecodeString(payload.Binary)
 
@@ -145,7 +261,21 @@ func (ctx *Ctx) receiveFromWs(msg js.Value) {
 		return
 	}
 
+	at := time.Now()
+	if payload.CachedAt != nil {
+		at = *payload.CachedAt
+	}
+	ctx.updateStatus(payload.ID, rpt, at)
+	if rpt.GetEepromRRpt() != nil {
+		ctx.eepromOf(payload.ID).update(rpt.GetEepromRRpt())
+		ctx.renderDiffSources()
+	}
+
 	str := payload.ID + "\n" + rpt.String()
+	if payload.CachedAt != nil {
+		// replayed by ws-kent from its last known state of the dispenser
+		str = payload.ID + " (cached " + time.Since(*payload.CachedAt).Round(time.Second).String() + " ago)\n" + rpt.String()
+	}
 
 	if payload.ID == ctx.getDispenserID() {
 		//append to correct log
@@ -154,326 +284,108 @@ func (ctx *Ctx) receiveFromWs(msg js.Value) {
 		if rpt.GetDispenserPidDbgRpt() != nil {
 			ctx.appendToPidLog(rpt)
 		} else if rpt.GetEepromRRpt() != nil {
-			ctx.parseEepromRead(rpt)
+			ctx.renderEeprom()
 		}
 	}
 }
 
-func (ctx *Ctx) appendToLog(msg string) {
-
-	t := time.Now()
+func (ctx *Ctx) updatePresence(devices []deviceData) {
 
-	timeStr := "[" + strconv.Itoa(t.Hour()) + ":" + strconv.Itoa(t.Minute()) + ":" + strconv.Itoa(t.Second()) + "]"
-	ctx.getElementByID("txtLogArea").Set("value", timeStr+" "+msg+"\n\n"+ctx.getElementString("txtLogArea", "value"))
-}
-
-func (ctx *Ctx) appendToPidLog(msg *kentpb.CliToSrv) {
-
-	append := ""
-
-	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetRun()+1)) + "\t"
-	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetCounter())) + "\t"
-	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetTime())) + "\t"
-	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetSp())) + "\t"
-	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetCv())) + "\t"
-	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetFError())) + "\t"
-	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetFInteg())) + "\t"
-	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetFDeriv())) + "\t"
-	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetP())) + "\t"
-	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetI())) + "\t"
-	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetD())) + "\t"
-	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetPv())) + "\n"
-
-	append = ctx.getElementByID("txtPidArea").Get("value").String() + append
-	ctx.getElementByID("txtPidArea").Set("value", append)
-}
-
-func (ctx *Ctx) parseEepromRead(msg *kentpb.CliToSrv) {
-
-	ctx.getElementByID("eepromExportData").Set("value", msg.String())
-
-	factoryRpt := msg.GetEepromRRpt().GetFactoryRpt()
-	if factoryRpt != nil {
-		ctx.getElementByID("txtFactoryDispenserId").Set("value", factoryRpt.GetId())
-		mac := factoryRpt.GetMac()
-		ctx.getElementByID("txtFactoryMac").Set("value", fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", mac[0], mac[1], mac[2], mac[3], mac[4], mac[5]))
-		ctx.getElementByID("cmbFactoryType").Set("value", int(factoryRpt.GetDeviceType()))
-		ctx.getElementByID("txtFactoryHwRev").Set("value", factoryRpt.GetHwRev())
-	}
-
-	stepperRpt := msg.GetEepromRRpt().GetStepperRpt()
-	if stepperRpt != nil {
-		idx, _ := strconv.ParseUint(ctx.getElementString("txtStepperIdx", "value"), 10, 32)
-		print("idx")
-		println(idx)
-		if idx >= NB_OF_STEPPERS {
-			idx = NB_OF_STEPPERS - 1
-		}
-		ctx.getElementByID("txtStepperDir").Set("value", stepperRpt[idx].GetDirection())
-		ctx.getElementByID("txtStepperSpeedRps").Set("value", float64(stepperRpt[idx].GetFSpeedMaxRps())/1000)
-		ctx.getElementByID("txtStepperAccelRps").Set("value", float64(stepperRpt[idx].GetFAccelRpss())/1000)
-		ctx.getElementByID("txtStepperDecelRps").Set("value", float64(stepperRpt[idx].GetFDecelRpss())/1000)
-		ctx.getElementByID("txtStepperHomeSpeedRps").Set("value", float64(stepperRpt[idx].GetFHomeSpeedRps())/1000)
-		ctx.getElementByID("txtStepperHomeAccelRps").Set("value", float64(stepperRpt[idx].GetFHomeAccelRpss())/1000)
-		ctx.getElementByID("txtStepperMaxCurrent").Set("value", stepperRpt[idx].GetCurrentMax())
-		ctx.getElementByID("txtStepperMinCurrent").Set("value", stepperRpt[idx].GetCurrentMin())
-		ctx.getElementByID("txtStepperHoldCurrent").Set("value", stepperRpt[idx].GetHoldCurrent())
-		ctx.getElementByID("txtStepperRetreatSpeed").Set("value", stepperRpt[idx].GetRetreatSpeedPct())
-		ctx.getElementByID("txtStepperRetreatAngle").Set("value", stepperRpt[idx].GetRetreatAngle())
-	}
-
-	pidRpt := msg.GetEepromRRpt().GetPidRpt()
-	if pidRpt != nil {
-		idx, _ := strconv.ParseUint(ctx.getElementString("txtPidIdx", "value"), 10, 32)
-		if idx >= NB_OF_PID_SETTINGS {
-			idx = NB_OF_PID_SETTINGS - 1
-		}
-		ctx.getElementByID("txtDispenseKp").Set("value", float64(pidRpt[idx].GetFKp())/1000)
-		ctx.getElementByID("txtDispenseKi").Set("value", float64(pidRpt[idx].GetFKi())/1000)
-		ctx.getElementByID("txtDispenseKd").Set("value", float64(pidRpt[idx].GetFKd())/1000)
-		ctx.getElementByID("txtDispenseSaturMax").Set("value", pidRpt[idx].GetSaturMax())
-		ctx.getElementByID("txtDispenseSaturMin").Set("value", pidRpt[idx].GetSaturMin())
-		ctx.getElementByID("txtDispensePidOffset").Set("value", pidRpt[idx].GetOffset())
-		ctx.getElementByID("txtDispenseSamplingT").Set("value", pidRpt[idx].GetSamplingTimeMs())
-	}
-
-	scaleRpt := msg.GetEepromRRpt().GetScaleRpt()
-	if scaleRpt != nil {
-		idx, _ := strconv.ParseUint(ctx.getElementString("txtScaleIdx", "value"), 10, 32)
-		if idx >= NB_OF_SCALES {
-			idx = NB_OF_SCALES - 1
-		}
-		ctx.getElementByID("txtScaleReadingSamples").Set("value", scaleRpt[idx].GetReadingSamples())
-		ctx.getElementByID("txtScaleCalibrWeight").Set("value", scaleRpt[idx].GetCalibWeightG())
-		ctx.getElementByID("txtScaleCalibrWSampl").Set("value", scaleRpt[idx].GetFullCalibSamples())
-		ctx.getElementByID("txtScaleTareSampl").Set("value", scaleRpt[idx].GetTareSamples())
-		ctx.getElementByID("txtScaleCalibrZeroSampl").Set("value", scaleRpt[idx].GetZeroCalibSamples())
-		ctx.getElementByID("txtScaleTrayWeight").Set("value", scaleRpt[idx].GetTrayWeightG())
-	}
-
-	dcMotorRpt := msg.GetEepromRRpt().GetDcmotRpt()
-	if dcMotorRpt != nil {
-		idx, _ := strconv.ParseUint(ctx.getElementString("txtDcMotorIdx", "value"), 10, 32)
-		if idx >= NB_OF_DC_MOTORS {
-			idx = NB_OF_DC_MOTORS - 1
+	for _, dev := range devices {
+		if dev.Online {
+			if _, known := ctx.devices[dev.ID]; !known {
+				ctx.appendToLog(dev.ID + " online " + dev.RemoteAddr)
+			}
+			ctx.devices[dev.ID] = dev
+		} else if _, known := ctx.devices[dev.ID]; known {
+			delete(ctx.devices, dev.ID)
+			delete(ctx.fleet, dev.ID)
+			ctx.dropUnacked(dev.ID)
+			ctx.appendToLog(dev.ID + " offline")
 		}
-		ctx.getElementByID("txtDcMotorSpeedPerc").Set("value", dcMotorRpt[idx].GetSpeedPct())
-		ctx.getElementByID("txtDcMotorDir").Set("value", dcMotorRpt[idx].GetDirection())
-		ctx.getElementByID("txtDcMotorRetreatSpeed").Set("value", dcMotorRpt[idx].GetRetreatSpeedPct())
-		ctx.getElementByID("txtDcMotorRetreatTime").Set("value", dcMotorRpt[idx].GetRetreatTimeMs())
 	}
 
-	massRpt := msg.GetEepromRRpt().GetMassRpt()
-	if massRpt != nil {
-		idx, _ := strconv.ParseUint(ctx.getElementString("txtDispenseMassIdx", "value"), 10, 32)
-		if idx >= NB_OF_MASS_SETTINGS {
-			idx = NB_OF_MASS_SETTINGS - 1
-		}
-		ctx.getElementByID("txtMassRunsMax").Set("value", massRpt[idx].GetRunMax())
-		ctx.getElementByID("txtMassDispenseTimeout").Set("value", massRpt[idx].GetDispensingTimeoutMs())
-	}
-
-	TemperatureControlRpt := msg.GetEepromRRpt().GetTemperatureRpt()
-	if TemperatureControlRpt != nil {
-		idx, _ := strconv.ParseUint(ctx.getElementString("txtTemperatureControlIdx", "value"), 10, 32)
-		ctx.getElementByID("txtTemperatureControlSetPoint").Set("value", TemperatureControlRpt[idx].GetFTemperatureC())
-		ctx.getElementByID("txtTemperatureControlTolerance").Set("value", TemperatureControlRpt[idx].GetFToleranceC())
-		ctx.getElementByID("cmbTemperatureControlMode").Set("value", uint32(TemperatureControlRpt[idx].GetMode()))
-	}
-
-	IngredientRpt := msg.GetEepromRRpt().GetIngredientRpt()
-	if IngredientRpt != nil {
-		ctx.getElementByID("txtIngredientName").Set("value", IngredientRpt[0].GetIngredient())
-	}
-
-	TransportRpt := msg.GetEepromRRpt().GetTransportRpt()
-	if TransportRpt != nil {
-		idx, _ := strconv.ParseUint(ctx.getElementString("txtTransportIdx", "value"), 10, 32)
-		print("transport idx")
-		println(idx)
-		Positions := TransportRpt[idx].GetPosition()
-		if Positions != nil {
-			ctx.getElementByID("txtPosition0Micro").Set("value", TransportRpt[idx].GetPosition()[0])
-			ctx.getElementByID("txtPosition1Micro").Set("value", TransportRpt[idx].GetPosition()[1])
-			ctx.getElementByID("txtPosition2Micro").Set("value", TransportRpt[idx].GetPosition()[2])
-			ctx.getElementByID("txtPosition3Micro").Set("value", TransportRpt[idx].GetPosition()[3])
-			ctx.getElementByID("txtPosition4Micro").Set("value", TransportRpt[idx].GetPosition()[4])
-			ctx.getElementByID("txtPosition5Micro").Set("value", TransportRpt[idx].GetPosition()[5])
-			ctx.getElementByID("txtPosition6Micro").Set("value", TransportRpt[idx].GetPosition()[6])
-			ctx.getElementByID("txtPosition7Micro").Set("value", TransportRpt[idx].GetPosition()[7])
-			ctx.getElementByID("txtPosition8Micro").Set("value", TransportRpt[idx].GetPosition()[8])
-			ctx.getElementByID("txtPosition9Micro").Set("value", TransportRpt[idx].GetPosition()[9])
-		}
-		ctx.getElementByID("txtToleranceMicro").Set("value", TransportRpt[idx].GetTolerance())
+	ctx.renderDeviceList()
+	for _, dev := range devices {
+		ctx.renderCard(dev.ID)
 	}
-
 }
 
-func (ctx *Ctx) EepromImport(this js.Value, i []js.Value) interface{} {
-
-	result := js.Global().Call("confirm", "All previous dispenser data will be overwritten by incoming settings but will not be written to the EEPROM. Are you sure you want to continue?")
-	if result.String() != "<boolean: true>" {
-		return 1
-	}
+/*
+renderDeviceList - Fill the device selector with the connected devices, keeping the
+current selection even when that device has gone offline.
+*/
+func (ctx *Ctx) renderDeviceList() {
 
-	exportData := ctx.getElementByID("eepromExportData").Get("value").String()
-	println(exportData)
+	selected := ctx.getDispenserID()
 
-	rpt := &kentpb.CliToSrv{}
-	err := proto.UnmarshalText(exportData, rpt)
-	if err != nil {
-		fmt.Println("Error unmarshaling", err)
-		return 1
+	ids := make([]string, 0, len(ctx.devices))
+	for id := range ctx.devices {
+		ids = append(ids, id)
 	}
+	sort.Strings(ids)
 
-	factoryRpt := rpt.GetEepromRRpt().GetFactoryRpt()
-	if factoryRpt != nil {
-		ctx.getElementByID("txtFactoryDispenserId").Set("value", factoryRpt.GetId())
-		mac := factoryRpt.GetMac()
-		ctx.getElementByID("txtFactoryMac").Set("value", fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", mac[0], mac[1], mac[2], mac[3], mac[4], mac[5]))
-		ctx.getElementByID("cmbFactoryType").Set("value", int(factoryRpt.GetDeviceType()))
-		ctx.getElementByID("txtFactoryHwRev").Set("value", factoryRpt.GetHwRev())
-	}
-
-	// scale
-	scaleRpt := rpt.GetEepromRRpt().GetScaleRpt()
-	if scaleRpt != nil {
-		for idx := 0; idx < NB_OF_SCALES; idx++ {
-			ctx.getElementByID("txtScaleIdx").Set("value", idx)
-			ctx.getElementByID("txtScaleReadingSamples").Set("value", scaleRpt[idx].GetReadingSamples())
-			ctx.getElementByID("txtScaleCalibrWeight").Set("value", scaleRpt[idx].GetCalibWeightG())
-			ctx.getElementByID("txtScaleCalibrWSampl").Set("value", scaleRpt[idx].GetFullCalibSamples())
-			ctx.getElementByID("txtScaleTareSampl").Set("value", scaleRpt[idx].GetTareSamples())
-			ctx.getElementByID("txtScaleCalibrZeroSampl").Set("value", scaleRpt[idx].GetZeroCalibSamples())
-			ctx.getElementByID("txtScaleTrayWeight").Set("value", scaleRpt[idx].GetTrayWeightG())
-			ctx.ScaleSetParams(this, i)
+	if selected != "" {
+		if _, ok := ctx.devices[selected]; !ok {
+			ids = append(ids, selected)
 		}
+	} else if len(ids) > 0 {
+		selected = ids[0]
 	}
 
-	time.Sleep(600 * time.Millisecond)
-
-	// stepper
-	stepperRpt := rpt.GetEepromRRpt().GetStepperRpt()
-	if stepperRpt != nil {
-		for idx := 0; idx < NB_OF_STEPPERS; idx++ {
-			ctx.getElementByID("txtStepperIdx").Set("value", idx)
-			ctx.getElementByID("txtStepperDir").Set("value", stepperRpt[idx].GetDirection())
-			ctx.getElementByID("txtStepperSpeedRps").Set("value", float64(stepperRpt[idx].GetFSpeedMaxRps())/1000)
-			ctx.getElementByID("txtStepperAccelRps").Set("value", float64(stepperRpt[idx].GetFAccelRpss())/1000)
-			ctx.getElementByID("txtStepperDecelRps").Set("value", float64(stepperRpt[idx].GetFDecelRpss())/1000)
-			ctx.getElementByID("txtStepperHomeSpeedRps").Set("value", float64(stepperRpt[idx].GetFHomeSpeedRps())/1000)
-			ctx.getElementByID("txtStepperHomeAccelRps").Set("value", float64(stepperRpt[idx].GetFHomeAccelRpss())/1000)
-			ctx.getElementByID("txtStepperMaxCurrent").Set("value", stepperRpt[idx].GetCurrentMax())
-			ctx.getElementByID("txtStepperMinCurrent").Set("value", stepperRpt[idx].GetCurrentMin())
-			ctx.getElementByID("txtStepperHoldCurrent").Set("value", stepperRpt[idx].GetHoldCurrent())
-			ctx.getElementByID("txtStepperRetreatSpeed").Set("value", stepperRpt[idx].GetRetreatSpeedPct())
-			ctx.getElementByID("txtStepperRetreatAngle").Set("value", stepperRpt[idx].GetRetreatAngle())
-			ctx.StepperSetParams(this, i)
-			time.Sleep(600 * time.Millisecond)
-		}
-	}
+	document := js.Global().Get("document")
+	list := ctx.getElementByID("txtDispenserId")
+	list.Set("innerHTML", "")
 
-	// dc motor
-	dcMotorRpt := rpt.GetEepromRRpt().GetDcmotRpt()
-	if dcMotorRpt != nil {
-		for idx := 0; idx < NB_OF_DC_MOTORS; idx++ {
-			ctx.getElementByID("txtDcMotorIdx").Set("value", idx)
-			ctx.getElementByID("txtDcMotorSpeedPerc").Set("value", dcMotorRpt[idx].GetSpeedPct())
-			ctx.getElementByID("txtDcMotorDir").Set("value", dcMotorRpt[idx].GetDirection())
-			ctx.getElementByID("txtDcMotorRetreatSpeed").Set("value", dcMotorRpt[idx].GetRetreatSpeedPct())
-			ctx.getElementByID("txtDcMotorRetreatTime").Set("value", dcMotorRpt[idx].GetRetreatTimeMs())
-			ctx.DcMotorSetParams(this, i)
+	for _, id := range ids {
+		label := id + " (offline)"
+		if dev, ok := ctx.devices[id]; ok {
+			label = id + " (" + dev.RemoteAddr + " since " + dev.ConnectedAt.Local().Format("15:04:05") + ")"
 		}
-	}
 
-	time.Sleep(600 * time.Millisecond)
-
-	// pid
-	pidRpt := rpt.GetEepromRRpt().GetPidRpt()
-	if pidRpt != nil {
-		for idx := 0; idx < NB_OF_PID_SETTINGS; idx++ {
-			ctx.getElementByID("txtPidIdx").Set("value", idx)
-			ctx.getElementByID("txtDispenseKp").Set("value", float64(pidRpt[idx].GetFKp())/1000)
-			ctx.getElementByID("txtDispenseKi").Set("value", float64(pidRpt[idx].GetFKi())/1000)
-			ctx.getElementByID("txtDispenseKd").Set("value", float64(pidRpt[idx].GetFKd())/1000)
-			ctx.getElementByID("txtDispenseSaturMax").Set("value", pidRpt[idx].GetSaturMax())
-			ctx.getElementByID("txtDispenseSaturMin").Set("value", pidRpt[idx].GetSaturMin())
-			ctx.getElementByID("txtDispensePidOffset").Set("value", pidRpt[idx].GetOffset())
-			ctx.getElementByID("txtDispenseSamplingT").Set("value", pidRpt[idx].GetSamplingTimeMs())
-			ctx.PidSetParams(this, i)
-		}
+		option := document.Call("createElement", "option")
+		option.Set("value", id)
+		option.Set("text", label)
+		list.Call("add", option)
 	}
 
-	time.Sleep(600 * time.Millisecond)
-
-	// mass
-	massRpt := rpt.GetEepromRRpt().GetMassRpt()
-	if massRpt != nil {
-		for idx := 0; idx < NB_OF_MASS_SETTINGS; idx++ {
-			ctx.getElementByID("txtDispenseMassIdx").Set("value", idx)
-			ctx.getElementByID("txtMassRunsMax").Set("value", massRpt[idx].GetRunMax())
-			ctx.getElementByID("txtMassDispenseTimeout").Set("value", massRpt[idx].GetDispensingTimeoutMs())
-			ctx.MassSetParams(this, i)
-		}
+	if selected != ctx.getDispenserID() {
+		list.Set("value", selected)
+	}
+	if ctx.wsConn && selected != ctx.subscribed {
+		ctx.subscribeSelected()
 	}
 
-	time.Sleep(600 * time.Millisecond)
+	ctx.renderDashboard()
+}
 
-	// temp control
-	temperatureControlRpt := rpt.GetEepromRRpt().GetTemperatureRpt()
-	if temperatureControlRpt != nil {
-		for idx := 0; idx < NB_OF_TEMP_CONTROLLERS; idx++ {
-			ctx.getElementByID("txtTemperatureControlIdx").Set("value", idx)
-			ctx.getElementByID("txtTemperatureControlSetPoint").Set("value", temperatureControlRpt[idx].GetFTemperatureC())
-			ctx.getElementByID("txtTemperatureControlTolerance").Set("value", temperatureControlRpt[idx].GetFToleranceC())
-			ctx.getElementByID("cmbTemperatureControlMode").Set("value", uint32(temperatureControlRpt[idx].GetMode()))
-			ctx.TemperatureControlSetParams(this, i)
-		}
-	}
+func (ctx *Ctx) appendToLog(msg string) {
 
-	time.Sleep(600 * time.Millisecond)
+	t := time.Now()
 
-	// ingredient
-	ingredientRpt := rpt.GetEepromRRpt().GetIngredientRpt()
-	if ingredientRpt != nil {
-		ctx.getElementByID("txtIngredientName").Set("value", ingredientRpt[0].GetIngredient())
-		ctx.IngredientSetParams(this, i)
-	}
+	timeStr := "[" + strconv.Itoa(t.Hour()) + ":" + strconv.Itoa(t.Minute()) + ":" + strconv.Itoa(t.Second()) + "]"
+	ctx.getElementByID("txtLogArea").Set("value", timeStr+" "+msg+"\n\n"+ctx.getElementString("txtLogArea", "value"))
+}
 
-	time.Sleep(600 * time.Millisecond)
-
-	// transport positions
-	transportRpt := rpt.GetEepromRRpt().GetTransportRpt()
-	if transportRpt != nil {
-		for idx := 0; idx < NB_OF_TRANSPORTS; idx++ {
-			ctx.getElementByID("txtTransportIdx").Set("value", idx)
-			Positions := transportRpt[idx].GetPosition()
-
-			if Positions != nil {
-				ctx.getElementByID("txtPosition0Micro").Set("value", transportRpt[idx].GetPosition()[0])
-				ctx.getElementByID("txtPosition1Micro").Set("value", Positions[1])
-				ctx.getElementByID("txtPosition2Micro").Set("value", Positions[2])
-				ctx.getElementByID("txtPosition3Micro").Set("value", Positions[3])
-				ctx.getElementByID("txtPosition4Micro").Set("value", Positions[4])
-				ctx.getElementByID("txtPosition5Micro").Set("value", Positions[5])
-				ctx.getElementByID("txtPosition6Micro").Set("value", Positions[6])
-				ctx.getElementByID("txtPosition7Micro").Set("value", Positions[7])
-				ctx.getElementByID("txtPosition8Micro").Set("value", Positions[8])
-				ctx.getElementByID("txtPosition9Micro").Set("value", Positions[9])
-			}
-			if Positions == nil {
-				print("transport idx")
-				println(idx)
-				print("nil")
-			}
-			ctx.getElementByID("txtToleranceMicro").Set("value", transportRpt[idx].GetTolerance())
+func (ctx *Ctx) appendToPidLog(msg *kentpb.CliToSrv) {
 
-			ctx.TransportPosSetParams(this, i)
-			time.Sleep(600 * time.Millisecond)
-		}
-	}
+	append := ""
 
-	return 1
+	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetRun()+1)) + "\t"
+	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetCounter())) + "\t"
+	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetTime())) + "\t"
+	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetSp())) + "\t"
+	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetCv())) + "\t"
+	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetFError())) + "\t"
+	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetFInteg())) + "\t"
+	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetFDeriv())) + "\t"
+	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetP())) + "\t"
+	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetI())) + "\t"
+	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetD())) + "\t"
+	append += strconv.Itoa(int(msg.GetDispenserPidDbgRpt().GetPv())) + "\n"
+
+	append = ctx.getElementByID("txtPidArea").Get("value").String() + append
+	ctx.getElementByID("txtPidArea").Set("value", append)
 }
 
 /*
@@ -510,18 +422,81 @@ func (ctx *Ctx) Connect(this js.Value, i []js.Value) interface{} {
 
 	ip := ctx.getElementString("txtBrokerIp", "value")
 	port := ctx.getElementString("txtBrokerPort", "value")
-	wsString := "ws://" + string(ip) + ":" + string(port) + "/ws"
 
-	ctx.wsSrv = js.Global().Get("WebSocket").New(wsString)
+	// Pages served over https may only open secure websockets
+	scheme := "ws://"
+	if ctx.getElementByID("chkBrokerTls").Get("checked").Bool() || js.Global().Get("location").Get("protocol").String() == "https:" {
+		scheme = "wss://"
+	}
+	wsString := scheme + string(ip) + ":" + string(port) + "/ws"
+
+	// A full websocket URL can also be given as the ws-kent address
+	if strings.HasPrefix(ip, "ws://") || strings.HasPrefix(ip, "wss://") {
+		wsString = ip
+	}
+
 	ctx.wsConn = true
 
+	user := ctx.getElementString("txtAuthUser", "value")
+	if user == "" {
+		ctx.openWs(wsString, ctx.getElementString("txtAuthToken", "value"))
+		return 1
+	}
+
+	// Log in first, the session token is then passed when opening the websocket
+	loginURL := "http" + strings.TrimPrefix(strings.TrimSuffix(wsString, "/ws"), "ws") + "/login"
+	form := js.Global().Get("URLSearchParams").New()
+	form.Call("append", "user", user)
+	form.Call("append", "password", ctx.getElementString("txtAuthPassword", "value"))
+
+	opts := js.Global().Get("Object").New()
+	opts.Set("method", "POST")
+	opts.Set("body", form)
+
+	js.Global().Call("fetch", loginURL, opts).Call("then", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if !args[0].Get("ok").Bool() {
+			ctx.wsConn = false
+			ctx.appendToLog("Login failed!")
+			return nil
+		}
+		return args[0].Call("json")
+	})).Call("then", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) == 0 || args[0].IsUndefined() || args[0].IsNull() {
+			return nil
+		}
+		ctx.appendToLog("Logged in as " + user + " (" + args[0].Get("Role").String() + ")")
+		ctx.getElementByID("txtAuthToken").Set("value", args[0].Get("Token").String())
+		ctx.openWs(wsString, args[0].Get("Token").String())
+		return nil
+	})).Call("catch", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		ctx.wsConn = false
+		ctx.appendToLog("Login failed!")
+		return nil
+	}))
+
+	return 1
+}
+
+/*
+openWs - Open the websocket to ws-kent, token authenticates the operator when set.
+*/
+func (ctx *Ctx) openWs(wsString string, token string) {
+
+	if token != "" {
+		wsString += "?token=" + js.Global().Call("encodeURIComponent", token).String()
+	}
+
+	ctx.wsSrv = js.Global().Get("WebSocket").New(wsString)
+
 	ctx.wsSrv.Call("addEventListener", "open", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
 		ctx.appendToLog("Connected!")
+		ctx.subscribeSelected()
 		return nil
 	}))
 
 	ctx.wsSrv.Call("addEventListener", "close", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
 		ctx.wsConn = false
+		ctx.dropUnacked("")
 		return nil
 	}))
 
@@ -532,10 +507,10 @@ func (ctx *Ctx) Connect(this js.Value, i []js.Value) interface{} {
 
 	ctx.wsSrv.Call("addEventListener", "error", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
 		ctx.wsConn = false
+		ctx.dropUnacked("")
 		ctx.appendToLog("Connection failed!")
 		return nil
 	}))
-	return 1
 }
 
 /*
@@ -545,18 +520,33 @@ func (ctx *Ctx) Disconnect(this js.Value, i []js.Value) interface{} {
 
 	ctx.wsSrv.Call("close")
 	ctx.wsConn = false
+	ctx.dropUnacked("")
 	ctx.appendToLog("Disconnected!")
 
 	return 1
 }
 
+/*
+SelectDevice - Scope the control panels to the device picked in the selector and
+get all its reports.
+*/
+func (ctx *Ctx) SelectDevice(this js.Value, i []js.Value) interface{} {
+
+	if ctx.wsConn {
+		ctx.subscribeSelected()
+	}
+	ctx.renderDashboard()
+	ctx.renderEeprom()
+	return 1
+}
+
 /*
 DispenserReboot -
 */
 func (ctx *Ctx) DispenserReboot(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -576,7 +566,7 @@ EepromRead -
 func (ctx *Ctx) EepromRead(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -594,7 +584,7 @@ EepromWrite -
 func (ctx *Ctx) EepromWrite(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -609,10 +599,11 @@ func (ctx *Ctx) EepromWrite(this js.Value, i []js.Value) interface{} {
 		ctx.IngredientSetParams(this, i)
 		ctx.TransportPosSetParams(this, i)
 
+		// The settings are read back and compared once the write is delivered
 		req := &kentpb.SrvToCli{
 			ReqOneof: &kentpb.SrvToCli_EepromWReq{},
 		}
-		ctx.sendToWs(ctx.getDispenserID(), req)
+		ctx.verifyWrite(ctx.getDispenserID(), ctx.sendToWs(ctx.getDispenserID(), req))
 	}
 
 	return 1
@@ -624,7 +615,7 @@ UpgradeFirmware -
 func (ctx *Ctx) UpgradeFirmware(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -652,7 +643,7 @@ FactoryChange -
 func (ctx *Ctx) FactoryChange(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -689,7 +680,7 @@ ScaleRead -
 func (ctx *Ctx) ScaleRead(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -717,7 +708,7 @@ func (ctx *Ctx) ScaleTare(this js.Value, i []js.Value) interface{} {
 	ctx.ScaleSetParams(this, i)
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -743,7 +734,7 @@ ScaleCalibFull -
 func (ctx *Ctx) ScaleCalibFull(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -770,7 +761,7 @@ ScaleCalibFull -
 func (ctx *Ctx) ScaleCalibZero(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -835,7 +826,7 @@ HopperRead -
 func (ctx *Ctx) HopperRead(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -861,7 +852,7 @@ HopperCalibrationOffset -
 func (ctx *Ctx) HopperCalibrationOffset(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -887,7 +878,7 @@ StepperRotate -
 func (ctx *Ctx) StepperRotate(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 	stepperIdx := ctx.getElementString("txtStepperIdx", "value")
@@ -916,7 +907,7 @@ StepperSpin -
 func (ctx *Ctx) StepperSpin(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -944,7 +935,7 @@ StepperStop -
 func (ctx *Ctx) StepperStop(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -968,7 +959,7 @@ StepperSetParams -
 func (ctx *Ctx) StepperSetParams(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -986,16 +977,17 @@ func (ctx *Ctx) StepperSetParams(this js.Value, i []js.Value) interface{} {
 	massRetreatAngle := ctx.getElementString("txtStepperRetreatAngle", "value")
 
 	idx, _ := strconv.ParseFloat(stepperIdx, 64)
+	// Fixed point values are rounded, 0.001 * 1000 doesn't truncate to 0
 	maxSpeed, _ := strconv.ParseFloat(stepperMaxSpeedRps, 64)
-	maxSpeed *= 1000
+	maxSpeed = math.Round(maxSpeed * 1000)
 	accl, _ := strconv.ParseFloat(stepperAccelRps, 64)
-	accl *= 1000
+	accl = math.Round(accl * 1000)
 	decl, _ := strconv.ParseFloat(stepperDecelRps, 64)
-	decl *= 1000
+	decl = math.Round(decl * 1000)
 	homeSpeed, _ := strconv.ParseFloat(stepperHomeSpeedRps, 64)
-	homeSpeed *= 1000
+	homeSpeed = math.Round(homeSpeed * 1000)
 	homeAccl, _ := strconv.ParseFloat(stepperHomeAccelRps, 64)
-	homeAccl *= 1000
+	homeAccl = math.Round(homeAccl * 1000)
 	dir, _ := strconv.ParseUint(stepperDirection, 10, 32)
 	maxCur, _ := strconv.ParseUint(stepperMaxCurrent, 10, 32)
 	minCur, _ := strconv.ParseUint(stepperMinCurrent, 10, 32)
@@ -1032,7 +1024,7 @@ VibratorRun -
 func (ctx *Ctx) VibratorRun(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1056,7 +1048,7 @@ VibratorStop -
 func (ctx *Ctx) VibratorStop(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1077,7 +1069,7 @@ DcMotorSpin -
 func (ctx *Ctx) DcMotorSpin(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1100,7 +1092,7 @@ DcMotorStop -
 func (ctx *Ctx) DcMotorStop(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1123,7 +1115,7 @@ DcMotorSetParams -
 func (ctx *Ctx) DcMotorSetParams(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1161,7 +1153,7 @@ DispenseMass -
 func (ctx *Ctx) DispenseMass(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1201,7 +1193,7 @@ MassSetParams -
 func (ctx *Ctx) MassSetParams(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1231,7 +1223,7 @@ CookToRate -
 */
 func (ctx *Ctx) CookToRate(this js.Value, i []js.Value) interface{} {
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1275,7 +1267,7 @@ FreezerActivate -
 */
 func (ctx *Ctx) FreezerActivate(this js.Value, i []js.Value) interface{} {
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1299,7 +1291,7 @@ FreezerDeactivate -
 */
 func (ctx *Ctx) FreezerDeactivate(this js.Value, i []js.Value) interface{} {
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1323,7 +1315,7 @@ FreezerUnlock -
 */
 func (ctx *Ctx) FreezerUnlock(this js.Value, i []js.Value) interface{} {
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1347,7 +1339,7 @@ HotHoldActivate -
 */
 func (ctx *Ctx) HotHoldActivate(this js.Value, i []js.Value) interface{} {
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1371,7 +1363,7 @@ HotHoldDeactivate -
 */
 func (ctx *Ctx) HotHoldDeactivate(this js.Value, i []js.Value) interface{} {
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1395,7 +1387,7 @@ ChangeOpMode -
 */
 func (ctx *Ctx) ChangeOpMode(this js.Value, i []js.Value) interface{} {
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1418,7 +1410,7 @@ TransportPosSetParams
 */
 func (ctx *Ctx) TransportPosSetParams(this js.Value, i []js.Value) interface{} {
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1469,11 +1461,11 @@ func (ctx *Ctx) PidSetParams(this js.Value, i []js.Value) interface{} {
 	pidIdx := ctx.getElementString("txtPidIdx", "value")
 
 	kp, _ := strconv.ParseFloat(pidKp, 64)
-	kp *= 1000
+	kp = math.Round(kp * 1000)
 	ki, _ := strconv.ParseFloat(pidKi, 64)
-	ki *= 1000
+	ki = math.Round(ki * 1000)
 	kd, _ := strconv.ParseFloat(pidKd, 64)
-	kd *= 1000
+	kd = math.Round(kd * 1000)
 	max, _ := strconv.ParseUint(pidSaturMax, 10, 32)
 	min, _ := strconv.ParseUint(pidSaturMin, 10, 32)
 	offset, _ := strconv.ParseUint(pidOffset, 10, 32)
@@ -1504,7 +1496,7 @@ GetState -
 */
 func (ctx *Ctx) GetState(this js.Value, i []js.Value) interface{} {
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1526,7 +1518,7 @@ DrawerLock -
 func (ctx *Ctx) DrawerLock(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1552,7 +1544,7 @@ DrawerUnlock -
 func (ctx *Ctx) DrawerUnlock(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1691,7 +1683,7 @@ TransportMove -
 func (ctx *Ctx) TransportMove(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1720,7 +1712,7 @@ func (ctx *Ctx) TransportMove(this js.Value, i []js.Value) interface{} {
 func (ctx *Ctx) StopAllSteppers(this js.Value, i []js.Value) interface{} {
 
 	if !ctx.wsConn {
-		ctx.appendToLog("Not Connected to Broker!")
+		ctx.appendToLog("Not Connected to ws-kent!")
 		return 1
 	}
 
@@ -1740,12 +1732,19 @@ func (ctx *Ctx) StopAllSteppers(this js.Value, i []js.Value) interface{} {
 func (ctx *Ctx) registerCallbacks() {
 	js.Global().Set("Connect", js.FuncOf(ctx.Connect))
 	js.Global().Set("Disconnect", js.FuncOf(ctx.Disconnect))
+	js.Global().Set("SelectDevice", js.FuncOf(ctx.SelectDevice))
 
 	js.Global().Set("DispenserReboot", js.FuncOf(ctx.DispenserReboot))
 	js.Global().Set("FactoryChange", js.FuncOf(ctx.FactoryChange))
 	js.Global().Set("EepromWrite", js.FuncOf(ctx.EepromWrite))
 	js.Global().Set("EepromRead", js.FuncOf(ctx.EepromRead))
+	js.Global().Set("EepromExport", js.FuncOf(ctx.EepromExport))
 	js.Global().Set("EepromImport", js.FuncOf(ctx.EepromImport))
+	js.Global().Set("ShowEepromParams", js.FuncOf(ctx.ShowEepromParams))
+	js.Global().Set("EepromDiff", js.FuncOf(ctx.EepromDiff))
+	js.Global().Set("EepromDiffFile", js.FuncOf(ctx.EepromDiffFile))
+	js.Global().Set("EepromDiffSelectAll", js.FuncOf(ctx.EepromDiffSelectAll))
+	js.Global().Set("EepromDiffApply", js.FuncOf(ctx.EepromDiffApply))
 	js.Global().Set("UpgradeFirmware", js.FuncOf(ctx.UpgradeFirmware))
 
 	js.Global().Set("ScaleRead", js.FuncOf(ctx.ScaleRead))
@@ -1810,6 +1809,14 @@ func main() {
 	// Init
 	ctx := Ctx{}
 	ctx.wsConn = false
+	ctx.devices = make(map[string]deviceData)
+	ctx.fleet = make(map[string]*deviceStatus)
+	ctx.cards = make(map[string]dashboardCard)
+	ctx.eeprom = make(map[string]*eepromModel)
+	ctx.written = make(map[string]*eepromModel)
+	ctx.verify = make(map[string]*eepromVerification)
+	ctx.pending = make(map[string]string)
+	ctx.unacked = make(map[string]eepromSent)
 
 	ctx.registerCallbacks()
 	pidAreaDefaultValue := "Run" + "\t" + "Loop" + "\t" + "t" + "\t" + "Sp" + "\t" + "Cv" + "\t" + "Err" + "\t" + "Int" + "\t" + "Der" + "\t" + "P" + "\t" + "I" + "\t" + "D" + "\t" + "Pv\n"
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+/*
+auditEntry - One line of the audit log, a request received from a websocket client.
+Error is set when the request was not passed on to the dispenser.
+*/
+type auditEntry struct {
+	Time       time.Time       `json:"time"`
+	Client     string          `json:"client"`
+	Operator   string          `json:"operator,omitempty"`
+	RemoteAddr string          `json:"remoteAddr"`
+	Dispenser  uuid.UUID       `json:"dispenser"`
+	Type       string          `json:"type"`
+	ReqID      string          `json:"reqId,omitempty"`
+	Payload    json.RawMessage `json:"payload"`
+	Error      string          `json:"error,omitempty"`
+}
+
+/*
+auditLog - Append-only JSON lines log of every request sent by websocket clients.
+The file is rotated to path.1 ... path.N once it grows past maxSize.
+*/
+type auditLog struct {
+	mutex    sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func newAuditLog(path string, maxSize int64, maxFiles int) (*auditLog, error) {
+
+	al := &auditLog{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := al.open(); err != nil {
+		return nil, err
+	}
+
+	return al, nil
+}
+
+func (al *auditLog) open() error {
+
+	f, err := os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	al.file = f
+	al.size = st.Size()
+	return nil
+}
+
+/*
+rotate - Shift path.N-1 to path.N down to path to path.1 and start a new file,
+the caller must hold the mutex. When path can't be moved it is reopened, the log
+keeps growing rather than losing every later entry.
+*/
+func (al *auditLog) rotate() error {
+
+	al.file.Close()
+
+	os.Remove(al.path + "." + strconv.Itoa(al.maxFiles))
+	for i := al.maxFiles - 1; i > 0; i-- {
+		os.Rename(al.path+"."+strconv.Itoa(i), al.path+"."+strconv.Itoa(i+1))
+	}
+	if al.maxFiles > 0 {
+		if err := os.Rename(al.path, al.path+".1"); err != nil {
+			return errors.Join(err, al.open())
+		}
+	} else {
+		os.Remove(al.path)
+	}
+
+	return al.open()
+}
+
+/*
+record - Append a request from a websocket client to the audit log, reqErr is why
+it was refused if it was. Safe to call on a nil log when auditing is disabled.
+*/
+func (al *auditLog) record(client *Client, msg wsMsg, req *kentpb.SrvToCli, reqErr error) {
+
+	if al == nil {
+		return
+	}
+
+	payload, err := protojson.Marshal(req)
+	if err != nil {
+		marshalErrors.Add(1)
+		log.Println("audit: marshalling", reqName(req), err)
+		payload = []byte("null")
+	}
+
+	entry := auditEntry{
+		Time:       time.Now(),
+		Client:     client.ID,
+		Operator:   client.Operator.name,
+		RemoteAddr: client.RemoteAddr,
+		Dispenser:  msg.ID,
+		Type:       reqName(req),
+		ReqID:      msg.ReqID,
+		Payload:    payload,
+	}
+	if reqErr != nil {
+		entry.Error = reqErr.Error()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("audit:", err)
+		return
+	}
+	line = append(line, '\n')
+
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	if al.maxSize > 0 && al.size > 0 && al.size+int64(len(line)) > al.maxSize {
+		if err := al.rotate(); err != nil {
+			log.Println("audit: rotating", al.path, err)
+		}
+	}
+
+	n, err := al.file.Write(line)
+	al.size += int64(n)
+	if err != nil {
+		log.Println("audit: writing", al.path, err)
+	}
+}
+
+func (al *auditLog) close() error {
+
+	if al == nil {
+		return nil
+	}
+
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	return al.file.Close()
+}
+
+/*
+auditQuery - The "audit" command, prints the audit log entries matching the given
+filters, oldest first.
+
+	ws-kent audit [-log <file>] [-device <uuid>] [-type <request>] [-since <time>] [-until <time>]
+*/
+func auditQuery(args []string) error {
+
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	path := fs.String("log", "ws-kent-audit.log", "Audit log to read, rotated files are read too")
+	device := fs.String("device", "", "Only requests sent to this dispenser ID")
+	reqType := fs.String("type", "", "Only requests of this type. ex: EepromScaleReq")
+	since := fs.String("since", "", "Only requests at or after this RFC3339 time")
+	until := fs.String("until", "", "Only requests before this RFC3339 time")
+	fs.Parse(args)
+
+	var from, to time.Time
+	var err error
+	if *since != "" {
+		if from, err = time.Parse(time.RFC3339, *since); err != nil {
+			return fmt.Errorf("-since: %w", err)
+		}
+	}
+	if *until != "" {
+		if to, err = time.Parse(time.RFC3339, *until); err != nil {
+			return fmt.Errorf("-until: %w", err)
+		}
+	}
+	var dispenserID uuid.UUID
+	if *device != "" {
+		if dispenserID, err = uuid.Parse(*device); err != nil {
+			return fmt.Errorf("-device: %w", err)
+		}
+	}
+
+	// Rotated files hold older entries, the highest number being the oldest
+	var files []string
+	for i := 1; ; i++ {
+		name := *path + "." + strconv.Itoa(i)
+		if _, err := os.Stat(name); err != nil {
+			break
+		}
+		files = append([]string{name}, files...)
+	}
+	files = append(files, *path)
+
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			var entry auditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				log.Println(name, err)
+				continue
+			}
+			if *device != "" && entry.Dispenser != dispenserID {
+				continue
+			}
+			if *reqType != "" && entry.Type != *reqType {
+				continue
+			}
+			if !from.IsZero() && entry.Time.Before(from) {
+				continue
+			}
+			if !to.IsZero() && !entry.Time.Before(to) {
+				continue
+			}
+			fmt.Println(scanner.Text())
+		}
+
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errUnauthorized = errors.New("unauthorized")
+
+var errForbidden = errors.New("forbidden")
+
+// How often expired sessions are removed.
+const sessionSweepInterval = time.Minute
+
+/*
+defaultRoles - The requests each role may send, by SrvToCli oneof name. "*" allows
+every request. Roles can be redefined or added in the auth file.
+*/
+var defaultRoles = map[string][]string{
+	"viewer": {
+		"EepromRReq",
+		"StateReq",
+		"DbgScaleReadReq",
+		"DispenserDbgHopperReadReq",
+	},
+	"technician": {
+		"EepromRReq",
+		"StateReq",
+		"DbgScaleReadReq",
+		"DispenserDbgHopperReadReq",
+		"EepromWReq",
+		"DbgScaleTareReq",
+		"ScaleCalibReq",
+		"EepromScaleReq",
+		"DispenserDbgHopperCalibOffsetReq",
+		"DbgStepperRotateReq",
+		"DbgStepperSpinReq",
+		"DbgStepperStopReq",
+		"EepromStepperReq",
+		"DispenserDbgVibratorRunReq",
+		"DispenserDbgVibratorStopReq",
+		"DbgDcmotorSpinReq",
+		"DbgDcmotorStopReq",
+		"EepromDcmotorReq",
+		"DispenserProcessReq",
+		"DispenserEepromMassReq",
+		"FryerProcessReq",
+		"FryerFreezerReq",
+		"FryerFreezerDrawerUnlockReq",
+		"FryerHotHoldReq",
+		"FryerSetOperatingStateReq",
+		"FryerEepromPositionsReq",
+		"EepromPidReq",
+		"DispenserTemperatureCtrlReq",
+		"EepromTemperatureReq",
+		"DispenserAgitationReq",
+		"EepromIngredientReq",
+		"TransportMoveReq",
+	},
+	"factory": {"*"},
+}
+
+/*
+authFile - The operators allowed to use ws-kent. Users log in with a password
+checked against its bcrypt hash, tokens are for scripts and jigs.
+
+	{
+		"users":  [{"name": "alice", "password": "$2a$10$...", "role": "factory"}],
+		"tokens": [{"name": "jig-1", "token": "...", "role": "technician"}],
+		"roles":  {"calibration": ["EepromRReq", "ScaleCalibReq"]}
+	}
+*/
+type authFile struct {
+	Users  []authCredential    `json:"users"`
+	Tokens []authCredential    `json:"tokens"`
+	Roles  map[string][]string `json:"roles"`
+}
+
+type authCredential struct {
+	Name     string `json:"name"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+	Role     string `json:"role"`
+}
+
+/*
+role - A named set of requests an operator may send to dispensers.
+*/
+type role struct {
+	name    string
+	all     bool
+	allowed map[string]bool
+}
+
+func newRole(name string, requests []string) *role {
+
+	r := &role{
+		name:    name,
+		allowed: make(map[string]bool),
+	}
+	for _, req := range requests {
+		if req == "*" {
+			r.all = true
+		}
+		r.allowed[req] = true
+	}
+
+	return r
+}
+
+/*
+allows - Whether the role may send req.
+*/
+func (r *role) allows(req *kentpb.SrvToCli) bool {
+	return r.all || r.allowed[reqName(req)]
+}
+
+/*
+operator - Who is behind a websocket connection and what they may do.
+*/
+type operator struct {
+	name    string
+	role    *role
+	expires time.Time
+}
+
+/*
+authenticator - Checks operator credentials and hands out session tokens.
+*/
+type authenticator struct {
+	mutex       sync.Mutex
+	sessionTTL  time.Duration
+	checkOrigin func(r *http.Request) bool
+	users       map[string]authCredential
+	tokens      map[string]operator
+	roles       map[string]*role
+	done        chan struct{}
+	stopOnce    sync.Once
+}
+
+/*
+loadAuth - Read the users, tokens and roles from an auth file.
+*/
+func loadAuth(path string, sessionTTL time.Duration) (*authenticator, error) {
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file authFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	auth := &authenticator{
+		sessionTTL: sessionTTL,
+		users:      make(map[string]authCredential),
+		tokens:     make(map[string]operator),
+		roles:      make(map[string]*role),
+		done:       make(chan struct{}),
+	}
+
+	for name, requests := range defaultRoles {
+		auth.roles[name] = newRole(name, requests)
+	}
+
+	known := kentRequestNames()
+	for name, requests := range file.Roles {
+		for _, req := range requests {
+			if req != "*" && !known[req] {
+				return nil, fmt.Errorf("role %s has unknown request %q", name, req)
+			}
+		}
+		auth.roles[name] = newRole(name, requests)
+	}
+
+	for _, user := range file.Users {
+		if _, ok := auth.roles[user.Role]; !ok {
+			return nil, fmt.Errorf("user %s has unknown role %q", user.Name, user.Role)
+		}
+		auth.users[user.Name] = user
+	}
+
+	for _, token := range file.Tokens {
+		r, ok := auth.roles[token.Role]
+		if !ok {
+			return nil, fmt.Errorf("token %s has unknown role %q", token.Name, token.Role)
+		}
+		if token.Token == "" {
+			return nil, fmt.Errorf("token %s is empty", token.Name)
+		}
+		auth.tokens[token.Token] = operator{
+			name: token.Name,
+			role: r,
+		}
+	}
+
+	return auth, nil
+}
+
+/*
+login - Check a user's password and start a session, returns the session token.
+*/
+func (auth *authenticator) login(name string, password string) (string, operator, error) {
+
+	user, ok := auth.users[name]
+	if !ok || bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		return "", operator{}, errUnauthorized
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", operator{}, err
+	}
+	token := hex.EncodeToString(b)
+
+	op := operator{
+		name:    user.Name,
+		role:    auth.roles[user.Role],
+		expires: time.Now().Add(auth.sessionTTL),
+	}
+
+	auth.mutex.Lock()
+	auth.tokens[token] = op
+	auth.mutex.Unlock()
+
+	return token, op, nil
+}
+
+/*
+authenticate - Find the operator behind a request from the token in its
+Authorization header or, for browsers that can't set headers on websockets,
+its token query parameter.
+*/
+func (auth *authenticator) authenticate(r *http.Request) (operator, error) {
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+
+	return auth.tokenOperator(token)
+}
+
+/*
+tokenOperator - The operator a session or API token belongs to.
+*/
+func (auth *authenticator) tokenOperator(token string) (operator, error) {
+
+	if token == "" {
+		return operator{}, errUnauthorized
+	}
+
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+
+	op, ok := auth.tokens[token]
+	if !ok {
+		return operator{}, errUnauthorized
+	}
+	if !op.expires.IsZero() && time.Now().After(op.expires) {
+		delete(auth.tokens, token)
+		return operator{}, errUnauthorized
+	}
+
+	return op, nil
+}
+
+/*
+sweep - Remove the expired sessions every interval until stop is called, tokens
+nobody uses again would otherwise be kept forever.
+*/
+func (auth *authenticator) sweep(interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-auth.done:
+			return
+		case now := <-ticker.C:
+			auth.removeExpired(now)
+		}
+	}
+}
+
+/*
+removeExpired - Remove the sessions expired at now.
+*/
+func (auth *authenticator) removeExpired(now time.Time) {
+
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+
+	for token, op := range auth.tokens {
+		if !op.expires.IsZero() && now.After(op.expires) {
+			delete(auth.tokens, token)
+		}
+	}
+}
+
+/*
+stop - Stop sweeping the expired sessions.
+*/
+func (auth *authenticator) stop() {
+
+	if auth == nil {
+		return
+	}
+
+	auth.stopOnce.Do(func() {
+		close(auth.done)
+	})
+}
+
+/*
+loginHandler - POST /login with user and password form values returns a session
+token to open the websocket with.
+*/
+func (auth *authenticator) loginHandler(w http.ResponseWriter, r *http.Request) {
+
+	// The webUI is usually served from another origin
+	if origin := r.Header.Get("Origin"); origin != "" && auth.checkOrigin != nil && auth.checkOrigin(r) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.FormValue("user")
+	token, op, err := auth.login(name, r.FormValue("password"))
+	if err != nil {
+		log.Println("failed login for", name)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	log.Println("login", op.name, "as", op.role.name)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Token   string
+		Role    string
+		Expires time.Time
+	}{token, op.role.name, op.expires})
+}
+
+/*
+hashPassword - Print the bcrypt hash of a password for the auth file.
+*/
+func hashPassword(password string) error {
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(hash))
+	return nil
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/iwdfryer/kent"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+bridgeConfig - Everything needed to build a bridge, filled from the command line
+by main.
+*/
+type bridgeConfig struct {
+	KentIP   string
+	KentPort string
+
+	// KentServer is used instead of a new kent server when set, e.g. to run the
+	// bridge against an in-process server.
+	KentServer kent.Server
+
+	Listen         string
+	TLSCert        string
+	TLSKey         string
+	AllowedOrigins []string
+
+	// GRPCListen is the address of the gRPC control service, none when empty.
+	GRPCListen string
+
+	// MQTTBroker is the URI of the MQTT broker reports are published to, none
+	// when empty. Commands from MQTT have MQTTRole when there is an auth file.
+	MQTTBroker   string
+	MQTTClientID string
+	MQTTRole     string
+
+	AuthFile   string
+	SessionTTL time.Duration
+
+	AuditLog      string
+	AuditMaxSize  int64
+	AuditMaxFiles int
+
+	// StoreDir keeps every report for StoreRetention, nothing is stored when empty.
+	StoreDir       string
+	StoreRetention time.Duration
+
+	RecordDir   string
+	Replay      []string
+	ReplaySpeed float64
+	ReplayLoop  bool
+	Simulate    string
+
+	// Reports forwarded to websocket clients, every report when empty, and
+	// reports never forwarded. Named like EepromRRpt.
+	Reports       []string
+	IgnoreReports []string
+
+	RespTimeout  time.Duration
+	SendInterval time.Duration
+	QueueSize    int
+}
+
+/*
+newBridge - Build a bridge from its configuration, nothing is started until start
+is called.
+*/
+func newBridge(cfg bridgeConfig) (*bridgeCtx, error) {
+
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return nil, errors.New("the TLS certificate and key must be given together")
+	}
+	if len(cfg.Replay) > 0 && cfg.RecordDir != "" {
+		return nil, errors.New("recording and replaying can't be used together")
+	}
+	if len(cfg.Replay) > 0 && cfg.ReplaySpeed <= 0 {
+		return nil, errors.New("the replay speed must be positive")
+	}
+	for _, path := range cfg.Replay {
+		if err := checkRecording(path); err != nil {
+			return nil, err
+		}
+	}
+	forwarded, err := forwardedReports(cfg.Reports, cfg.IgnoreReports)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := &bridgeCtx{
+		cfg:       cfg,
+		cl:        newClientList(),
+		devices:   newDeviceRegistry(),
+		errc:      make(chan error, 2),
+		done:      make(chan struct{}),
+		metrics:   newBridgeMetrics(),
+		cache:     newStateCache(),
+		forwarded: forwarded,
+	}
+	ctx.requests = newPendingRequests(cfg.RespTimeout)
+	ctx.queues = newOutboundQueues(cfg.QueueSize, cfg.SendInterval, ctx.sendToDispenser)
+	ctx.replayed = len(cfg.Replay) > 0
+
+	ctx.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     originChecker(cfg.AllowedOrigins),
+		Subprotocols:    []string{wsProtocolJSON},
+	}
+
+	if cfg.AuthFile != "" {
+		auth, err := loadAuth(cfg.AuthFile, cfg.SessionTTL)
+		if err != nil {
+			return nil, err
+		}
+		auth.checkOrigin = ctx.upgrader.CheckOrigin
+		ctx.auth = auth
+	} else {
+		log.Println("no auth file given, every websocket client has full access")
+	}
+
+	if cfg.AuditLog != "" {
+		audit, err := newAuditLog(cfg.AuditLog, cfg.AuditMaxSize, cfg.AuditMaxFiles)
+		if err != nil {
+			return nil, err
+		}
+		ctx.audit = audit
+	}
+
+	if cfg.RecordDir != "" {
+		recorder, err := newSessionRecorder(cfg.RecordDir)
+		if err != nil {
+			ctx.closeLogs()
+			return nil, err
+		}
+		ctx.recorder = recorder
+	}
+
+	if cfg.StoreDir != "" {
+		store, err := newReportStore(cfg.StoreDir, cfg.StoreRetention)
+		if err != nil {
+			ctx.closeLogs()
+			return nil, err
+		}
+		ctx.store = store
+	}
+
+	if !ctx.replayed {
+		srv := cfg.KentServer
+		if srv == nil {
+			srv = kent.NewKentServer()
+		}
+		ctx.simSrv = newSimServer(srv)
+		ctx.tcpSrv = ctx.simSrv
+
+		if cfg.Simulate != "" {
+			sim, err := newSimulator(cfg.Simulate)
+			if err != nil {
+				ctx.audit.close()
+				return nil, err
+			}
+			ctx.sim = sim
+		}
+		ctx.kentSubscribe()
+	}
+
+	if cfg.GRPCListen != "" {
+		grpcSrv, err := ctx.newGRPCServer()
+		if err != nil {
+			ctx.closeLogs()
+			return nil, err
+		}
+		ctx.grpcSrv = grpcSrv
+	}
+
+	if cfg.MQTTBroker != "" {
+		op := anonymousOperator
+		if ctx.auth != nil {
+			r, ok := ctx.auth.roles[cfg.MQTTRole]
+			if !ok {
+				ctx.closeLogs()
+				return nil, fmt.Errorf("unknown MQTT role %q", cfg.MQTTRole)
+			}
+			op = operator{name: "mqtt", role: r}
+		}
+		ctx.mqtt = ctx.newMQTTBridge(cfg.MQTTBroker, cfg.MQTTClientID, op)
+	}
+
+	ctx.wsSrv = http.NewServeMux()
+	ctx.wsSrv.HandleFunc("/ws", ctx.websocketHandler)
+	if ctx.auth != nil {
+		ctx.wsSrv.HandleFunc("/login", ctx.auth.loginHandler)
+	}
+	ctx.wsSrv.HandleFunc("/metrics", ctx.metricsHandler)
+	ctx.wsSrv.HandleFunc("/devices", ctx.restDevices)
+	ctx.wsSrv.HandleFunc("/devices/", ctx.restDevice)
+	ctx.wsSrv.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "static")
+	})
+
+	return ctx, nil
+}
+
+/*
+start - Start the kent server, or the replay, and the websocket server. Returns
+once both are accepting connections.
+*/
+func (ctx *bridgeCtx) start() error {
+
+	listener, err := net.Listen("tcp", ctx.cfg.Listen)
+	if err != nil {
+		return err
+	}
+
+	if ctx.replayed {
+		fmt.Println("Replaying", ctx.cfg.Replay, "once a websocket client connects")
+		ctx.replaying.Add(1)
+		go func() {
+			defer ctx.replaying.Done()
+			ctx.replay(ctx.cfg.Replay, ctx.cfg.ReplaySpeed, ctx.cfg.ReplayLoop)
+		}()
+	} else {
+		if err := ctx.tcpSrv.StartServer(ctx.cfg.KentIP, ctx.cfg.KentPort); err != nil {
+			listener.Close()
+			return fmt.Errorf("starting kent server on %s:%s: %w", ctx.cfg.KentIP, ctx.cfg.KentPort, err)
+		}
+		ctx.kentStarted = true
+		if ctx.sim != nil {
+			ctx.sim.start(ctx.simSrv)
+		}
+	}
+
+	if ctx.grpcSrv != nil {
+		if err := ctx.startGRPC(ctx.cfg.GRPCListen); err != nil {
+			listener.Close()
+			ctx.stop()
+			return err
+		}
+	}
+
+	if ctx.mqtt != nil {
+		ctx.mqtt.start()
+	}
+
+	if ctx.auth != nil {
+		go ctx.auth.sweep(sessionSweepInterval)
+	}
+
+	ctx.listener = listener
+	ctx.httpSrv = &http.Server{Handler: ctx.wsSrv}
+
+	go func() {
+		var err error
+		if ctx.cfg.TLSCert != "" {
+			fmt.Println("Server is running: wss://" + listener.Addr().String())
+			err = ctx.httpSrv.ServeTLS(listener, ctx.cfg.TLSCert, ctx.cfg.TLSKey)
+		} else {
+			fmt.Println("Server is running: ws://" + listener.Addr().String())
+			err = ctx.httpSrv.Serve(listener)
+		}
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+		ctx.errc <- err
+	}()
+
+	return nil
+}
+
+/*
+addr - The address the websocket server listens on, useful when listening on port 0.
+*/
+func (ctx *bridgeCtx) addr() net.Addr {
+	return ctx.listener.Addr()
+}
+
+/*
+wait - Block until the websocket or gRPC server stops, returns why it stopped or
+nil after stop.
+*/
+func (ctx *bridgeCtx) wait() error {
+	return <-ctx.errc
+}
+
+/*
+kentStopServer - Implemented by kent servers able to stop listening and drop their
+dispensers, not every kent release can.
+*/
+type kentStopServer interface {
+	Stop() error
+}
+
+/*
+stop - Stop everything the bridge runs straight away: the websocket and gRPC
+servers, the replay, the simulated devices and the kent server when it can be, the outbound
+queues and the pending requests. Then disconnect every client and the MQTT broker
+and close the logs. Nothing the bridge started is left running once it returns.
+*/
+func (ctx *bridgeCtx) stop() error {
+
+	var errs []error
+	ctx.stopOnce.Do(func() {
+		close(ctx.done)
+
+		if ctx.httpSrv != nil {
+			if err := ctx.httpSrv.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if ctx.grpcListener != nil {
+			ctx.grpcSrv.Stop()
+		}
+
+		// The dispensers disconnecting stop their queues and recordings
+		ctx.replaying.Wait()
+		ctx.sim.stop()
+		if srv, ok := ctx.tcpSrv.(kentStopServer); ok && ctx.kentStarted {
+			if err := srv.Stop(); err != nil {
+				errs = append(errs, fmt.Errorf("stopping kent server: %w", err))
+			}
+		}
+
+		ctx.queues.close()
+		ctx.queues.stopAll()
+		ctx.queues.wait()
+		ctx.requests.stopAll()
+
+		ctx.cl.closeAll()
+		ctx.mqtt.stop()
+		if err := ctx.closeLogs(); err != nil {
+			errs = append(errs, err)
+		}
+	})
+
+	return errors.Join(errs...)
+}
+
+/*
+closeLogs - End the session sweep and close the audit log, the recordings and the
+report store, whichever were opened.
+*/
+func (ctx *bridgeCtx) closeLogs() error {
+
+	var errs []error
+
+	ctx.auth.stop()
+	if err := ctx.audit.close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing audit log: %w", err))
+	}
+	ctx.recorder.close()
+	if err := ctx.store.close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing report store: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+/*
+shutdown - Stop gracefully: refuse new websocket clients and requests, send what
+is queued for the dispensers, close the browsers' connections with a close frame,
+and end the gRPC calls. Then stop the rest like stop does, the kent server
+included. Whatever is left when ctx is done is dropped.
+*/
+func (ctx *bridgeCtx) shutdown(sctx context.Context) error {
+
+	var errs []error
+
+	// No new websocket clients
+	if ctx.httpSrv != nil {
+		if err := ctx.httpSrv.Shutdown(sctx); err != nil {
+			errs = append(errs, fmt.Errorf("stopping websocket server: %w", err))
+		}
+	}
+
+	// No new gRPC calls, the running ones end with the queues and clients below
+	grpcStopped := make(chan struct{})
+	if ctx.grpcListener != nil {
+		go func() {
+			ctx.grpcSrv.GracefulStop()
+			close(grpcStopped)
+		}()
+	}
+
+	ctx.queues.close()
+	if err := ctx.queues.drain(sctx); err != nil {
+		errs = append(errs, fmt.Errorf("draining outbound queues: %w", err))
+	}
+	for _, m := range ctx.queues.stopAll() {
+		ctx.ack(m.client, m.msg, nil, errShuttingDown)
+	}
+
+	ctx.cl.shutdownAll(sctx)
+
+	if ctx.grpcListener != nil {
+		select {
+		case <-grpcStopped:
+		case <-sctx.Done():
+			errs = append(errs, fmt.Errorf("stopping gRPC server: %w", sctx.Err()))
+		}
+	}
+
+	if err := ctx.stop(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
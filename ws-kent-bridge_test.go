@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/iwdfryer/kent"
+	"github.com/iwdfryer/kent/proto/kentpb"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// How long the tests wait for a message before failing.
+const testWait = 5 * time.Second
+
+/*
+freePort - A TCP port nothing listens on, for the kent server.
+*/
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+/*
+startBridge - Start a bridge configured by cfg with a kent server on a free port,
+the test devices are attached to it in process. Stopped when the test ends. Requests time out after testWait unless
+cfg says otherwise.
+*/
+func startBridge(t *testing.T, cfg bridgeConfig) *bridgeCtx {
+	t.Helper()
+
+	cfg.KentIP = "127.0.0.1"
+	cfg.KentPort = freePort(t)
+	cfg.KentServer = kent.NewKentServer()
+	cfg.Listen = "127.0.0.1:0"
+	if cfg.RespTimeout == 0 {
+		cfg.RespTimeout = testWait
+	}
+	cfg.SendInterval = time.Millisecond
+	cfg.QueueSize = 64
+
+	ctx, err := newBridge(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := ctx.stop(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return ctx
+}
+
+/*
+fakeDevice - A dispenser attached to the kent server of the bridge, handing the
+requests it gets to the test.
+*/
+type fakeDevice struct {
+	id   uuid.UUID
+	srv  *simServer
+	conn *simConn
+}
+
+func connectDevice(t *testing.T, ctx *bridgeCtx) *fakeDevice {
+	t.Helper()
+
+	dev := &fakeDevice{
+		id:  uuid.New(),
+		srv: ctx.simSrv,
+	}
+	dev.conn = dev.srv.attach(dev.id)
+	t.Cleanup(dev.disconnect)
+
+	waitFor(t, testWait, "the device to come online", func() bool {
+		return ctx.devices.isOnline(dev.id)
+	})
+
+	return dev
+}
+
+func (dev *fakeDevice) disconnect() {
+	dev.srv.detach(dev.id)
+}
+
+func (dev *fakeDevice) request(t *testing.T) *kentpb.SrvToCli {
+	t.Helper()
+
+	select {
+	case req := <-dev.conn.requests:
+		return req
+	case <-time.After(testWait):
+		t.Fatal("the device got no request")
+		return nil
+	}
+}
+
+func (dev *fakeDevice) report(t *testing.T, rpt *kentpb.CliToSrv) {
+	t.Helper()
+
+	dev.srv.report(dev.id, rpt)
+}
+
+/*
+wsClient - A websocket client of the bridge, the messages it gets are read into
+msgs.
+*/
+type wsClient struct {
+	conn      *websocket.Conn
+	protojson bool
+	msgs      chan wsMsg
+}
+
+func dialBridge(t *testing.T, ctx *bridgeCtx, query string, subprotocols ...string) *wsClient {
+	t.Helper()
+
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	conn, _, err := dialer.Dial("ws://"+ctx.addr().String()+"/ws"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	client := &wsClient{
+		conn:      conn,
+		protojson: conn.Subprotocol() == wsProtocolJSON,
+		msgs:      make(chan wsMsg, 1024),
+	}
+	go func() {
+		defer close(client.msgs)
+		for {
+			var msg wsMsg
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			client.msgs <- msg
+		}
+	}()
+
+	return client
+}
+
+/*
+expect - Read messages until one matches, failing the test after testWait.
+*/
+func (c *wsClient) expect(t *testing.T, what string, match func(msg wsMsg) bool) wsMsg {
+	t.Helper()
+
+	timeout := time.After(testWait)
+	for {
+		select {
+		case msg, ok := <-c.msgs:
+			if !ok {
+				t.Fatalf("connection closed waiting for %s", what)
+			}
+			if match(msg) {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+/*
+send - Send a request to a dispenser, encoded like the webUI does or as protojson.
+*/
+func (c *wsClient) send(t *testing.T, dispenserID uuid.UUID, reqID string, req *kentpb.SrvToCli) {
+	t.Helper()
+
+	msg := wsMsg{ID: dispenserID, ReqID: reqID}
+	if c.protojson {
+		b, err := protojson.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Msg = b
+	} else {
+		b, err := proto.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Binary = base64.StdEncoding.EncodeToString(b)
+	}
+
+	if err := c.conn.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/*
+decodeReport - The report carried by a message from the bridge.
+*/
+func (c *wsClient) decodeReport(t *testing.T, msg wsMsg) *kentpb.CliToSrv {
+	t.Helper()
+
+	rpt := &kentpb.CliToSrv{}
+	if c.protojson {
+		if err := protojson.Unmarshal(msg.Msg, rpt); err != nil {
+			t.Fatal(err)
+		}
+		return rpt
+	}
+
+	b, err := base64.StdEncoding.DecodeString(msg.Binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proto.Unmarshal(b, rpt); err != nil {
+		t.Fatal(err)
+	}
+	return rpt
+}
+
+/*
+everyRequest - A request of every SrvToCli type, named like EepromRReq.
+*/
+func everyRequest() map[string]*kentpb.SrvToCli {
+
+	reqs := make(map[string]*kentpb.SrvToCli)
+
+	oneofs := (&kentpb.SrvToCli{}).ProtoReflect().Descriptor().Oneofs()
+	for i := 0; i < oneofs.Len(); i++ {
+		fields := oneofs.Get(i).Fields()
+		for j := 0; j < fields.Len(); j++ {
+			req := &kentpb.SrvToCli{}
+			m := req.ProtoReflect()
+			m.Set(fields.Get(j), m.NewField(fields.Get(j)))
+			reqs[reqName(req)] = req
+		}
+	}
+
+	return reqs
+}
+
+/*
+reportOf - A report with the given oneof wrapper type, e.g. *kentpb.CliToSrv_EepromRRpt.
+*/
+func reportOf(t *testing.T, wrapper reflect.Type) *kentpb.CliToSrv {
+	t.Helper()
+
+	oneofs := (&kentpb.CliToSrv{}).ProtoReflect().Descriptor().Oneofs()
+	for i := 0; i < oneofs.Len(); i++ {
+		fields := oneofs.Get(i).Fields()
+		for j := 0; j < fields.Len(); j++ {
+			rpt := &kentpb.CliToSrv{}
+			m := rpt.ProtoReflect()
+			m.Set(fields.Get(j), m.NewField(fields.Get(j)))
+			if oneofType(rpt) == wrapper {
+				return rpt
+			}
+		}
+	}
+
+	t.Fatalf("no report of type %s", wrapper)
+	return nil
+}
+
+func TestBridgeRoundTripsEveryRequest(t *testing.T) {
+
+	for _, protocol := range []string{"", wsProtocolJSON} {
+		t.Run("protocol="+protocol, func(t *testing.T) {
+
+			ctx := startBridge(t, bridgeConfig{})
+			dev := connectDevice(t, ctx)
+
+			var client *wsClient
+			if protocol == "" {
+				client = dialBridge(t, ctx, "?devices="+dev.id.String())
+			} else {
+				client = dialBridge(t, ctx, "?devices="+dev.id.String(), protocol)
+			}
+
+			for name, req := range everyRequest() {
+				client.send(t, dev.id, name, req)
+
+				if got := dev.request(t); !proto.Equal(got, req) {
+					t.Fatalf("%s: the device got %v", name, got)
+				}
+
+				ack := client.expect(t, "the ack of "+name, func(msg wsMsg) bool {
+					return msg.Type == wsMsgAck && msg.ReqID == name
+				})
+				if ack.Error != "" {
+					t.Fatalf("%s: %s", name, ack.Error)
+				}
+
+				wrapper, answered := kentResponses[reflect.TypeOf(req.GetReqOneof())]
+				if !answered {
+					if ack.Awaiting != "" {
+						t.Fatalf("%s: awaiting %s, it has no response", name, ack.Awaiting)
+					}
+					continue
+				}
+
+				rpt := reportOf(t, wrapper)
+				if ack.Awaiting != reportName(rpt) {
+					t.Fatalf("%s: awaiting %q, want %q", name, ack.Awaiting, reportName(rpt))
+				}
+				dev.report(t, rpt)
+
+				resp := client.expect(t, "the response to "+name, func(msg wsMsg) bool {
+					return msg.Type == wsMsgResponse && msg.ReqID == name
+				})
+				if resp.ID != dev.id || !proto.Equal(client.decodeReport(t, resp), rpt) {
+					t.Fatalf("%s: wrong response %+v", name, resp)
+				}
+			}
+		})
+	}
+}
+
+func TestBridgeForwardsEveryReport(t *testing.T) {
+
+	ctx := startBridge(t, bridgeConfig{})
+	dev := connectDevice(t, ctx)
+	other := connectDevice(t, ctx)
+
+	clients := []*wsClient{
+		dialBridge(t, ctx, "?devices="+dev.id.String()),
+		dialBridge(t, ctx, "?devices="+dev.id.String(), wsProtocolJSON),
+	}
+	otherClient := dialBridge(t, ctx, "?devices="+other.id.String())
+
+	for _, wrapper := range kentReports() {
+		rpt := reportOf(t, reflect.TypeOf(wrapper))
+		dev.report(t, rpt)
+
+		for _, client := range clients {
+			msg := client.expect(t, rptName(wrapper), func(msg wsMsg) bool {
+				return msg.Type == wsMsgKent && msg.ID == dev.id
+			})
+			if got := client.decodeReport(t, msg); !proto.Equal(got, rpt) {
+				t.Fatalf("%s: the client got %v", rptName(wrapper), got)
+			}
+		}
+	}
+
+	// Reports of another dispenser only reach its subscribers
+	other.report(t, reportOf(t, reflect.TypeOf(&kentpb.CliToSrv_LogRpt{})))
+	otherClient.expect(t, "the report of the other dispenser", func(msg wsMsg) bool {
+		return msg.Type == wsMsgKent && msg.ID == other.id
+	})
+	for _, client := range clients {
+		select {
+		case msg := <-client.msgs:
+			if msg.Type == wsMsgKent {
+				t.Fatalf("a client got a report of a dispenser it isn't subscribed to: %+v", msg)
+			}
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func TestBridgeFiltersOnlyWebsocketReports(t *testing.T) {
+
+	ctx := startBridge(t, bridgeConfig{Reports: []string{"LogRpt", "FryerStateRpt"}, IgnoreReports: []string{"FryerStateRpt"}})
+	dev := connectDevice(t, ctx)
+	client := dialBridge(t, ctx, "?devices="+dev.id.String())
+
+	state := reportOf(t, reflect.TypeOf(&kentpb.CliToSrv_DispenserStateRpt{}))
+	dev.report(t, state)
+	dev.report(t, reportOf(t, reflect.TypeOf(&kentpb.CliToSrv_FryerStateRpt{})))
+	dev.report(t, reportOf(t, reflect.TypeOf(&kentpb.CliToSrv_LogRpt{})))
+
+	// Reports arrive in order, so the filtered ones were never forwarded
+	msg := client.expect(t, "a report", func(msg wsMsg) bool {
+		return msg.Type == wsMsgKent
+	})
+	if name := reportName(client.decodeReport(t, msg)); name != "LogRpt" {
+		t.Fatalf("the client got %s, only LogRpt is forwarded", name)
+	}
+
+	// The others still reach the bridge
+	cached := ctx.cache.get(func(id uuid.UUID, _ string) bool { return id == dev.id })
+	if len(cached) != 2 {
+		t.Fatalf("%d reports cached, want DispenserStateRpt and FryerStateRpt", len(cached))
+	}
+
+	// Nor are they replayed from the cache to later clients
+	late := dialBridge(t, ctx, "?devices="+dev.id.String())
+	dev.report(t, reportOf(t, reflect.TypeOf(&kentpb.CliToSrv_LogRpt{})))
+	msg = late.expect(t, "a report", func(msg wsMsg) bool {
+		return msg.Type == wsMsgKent
+	})
+	if msg.CachedAt != nil {
+		t.Fatalf("a later client got the cached %s", reportName(late.decodeReport(t, msg)))
+	}
+}
+
+func TestBridgeWatchedReports(t *testing.T) {
+
+	ctx := startBridge(t, bridgeConfig{})
+	selected := connectDevice(t, ctx)
+	other := connectDevice(t, ctx)
+
+	state := reportOf(t, reflect.TypeOf(&kentpb.CliToSrv_FryerStateRpt{}))
+	other.report(t, state)
+	waitFor(t, testWait, "the state to be cached", func() bool {
+		return len(ctx.cache.get(func(id uuid.UUID, _ string) bool { return id == other.id })) == 1
+	})
+
+	client := dialBridge(t, ctx, "")
+	err := client.conn.WriteJSON(wsMsg{
+		Type:    wsMsgSubscribe,
+		Devices: []string{selected.id.String()},
+		Reports: []string{"FryerStateRpt"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The watched report of the other device is sent from the cache, then live
+	cached := client.expect(t, "the cached state", func(msg wsMsg) bool {
+		return msg.Type == wsMsgKent && msg.ID == other.id
+	})
+	if cached.CachedAt == nil || reportName(client.decodeReport(t, cached)) != "FryerStateRpt" {
+		t.Fatalf("wrong cached report %+v", cached)
+	}
+
+	other.report(t, reportOf(t, reflect.TypeOf(&kentpb.CliToSrv_LogRpt{})))
+	other.report(t, state)
+	selected.report(t, reportOf(t, reflect.TypeOf(&kentpb.CliToSrv_LogRpt{})))
+
+	var got []string
+	for len(got) < 2 {
+		msg := client.expect(t, "a report", func(msg wsMsg) bool {
+			return msg.Type == wsMsgKent
+		})
+		got = append(got, msg.ID.String()+" "+reportName(client.decodeReport(t, msg)))
+	}
+	// The devices' reports may interleave, each device's arrive in order
+	want := []string{other.id.String() + " FryerStateRpt", selected.id.String() + " LogRpt"}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got reports %v, want %v", got, want)
+	}
+
+	if err := ctx.cl.watch(newLocalClient(anonymousOperator, "test"), []string{"NoSuchRpt"}); err == nil {
+		t.Fatal("watching an unknown report")
+	}
+}
+
+func TestBridgePresenceAndOfflineDevices(t *testing.T) {
+
+	ctx := startBridge(t, bridgeConfig{})
+	client := dialBridge(t, ctx, "")
+	client.expect(t, "the device list", func(msg wsMsg) bool {
+		return msg.Type == wsMsgDevices
+	})
+
+	dev := connectDevice(t, ctx)
+	online := client.expect(t, "the device to come online", func(msg wsMsg) bool {
+		return msg.Type == wsMsgPresence && msg.ID == dev.id
+	})
+	if !online.Presence[0].Online || online.Presence[0].RemoteAddr == "" {
+		t.Fatalf("wrong presence %+v", online.Presence[0])
+	}
+
+	dev.disconnect()
+	client.expect(t, "the device to go offline", func(msg wsMsg) bool {
+		return msg.Type == wsMsgPresence && msg.ID == dev.id && !msg.Presence[0].Online
+	})
+
+	client.send(t, dev.id, "1", &kentpb.SrvToCli{ReqOneof: &kentpb.SrvToCli_EepromRReq{EepromRReq: &kentpb.Empty{}}})
+	ack := client.expect(t, "the ack", func(msg wsMsg) bool {
+		return msg.Type == wsMsgAck && msg.ReqID == "1"
+	})
+	if ack.Error != errDeviceOffline.Error() {
+		t.Fatalf("request to an offline device acked with %q", ack.Error)
+	}
+}
+
+func TestBridgeTimesOutUnansweredRequests(t *testing.T) {
+
+	ctx := startBridge(t, bridgeConfig{RespTimeout: 100 * time.Millisecond})
+	dev := connectDevice(t, ctx)
+	client := dialBridge(t, ctx, "?devices="+dev.id.String())
+
+	client.send(t, dev.id, "1", &kentpb.SrvToCli{ReqOneof: &kentpb.SrvToCli_EepromRReq{EepromRReq: &kentpb.Empty{}}})
+	dev.request(t)
+
+	timeout := client.expect(t, "the timeout", func(msg wsMsg) bool {
+		return msg.Type == wsMsgTimeout && msg.ReqID == "1"
+	})
+	if timeout.Error == "" {
+		t.Fatal("timeout without an error")
+	}
+}
+
+func TestBridgeStopsAndStartsAgain(t *testing.T) {
+
+	for i := 0; i < 4; i++ {
+		// Not every kent server can be stopped to free its port
+		ctx, err := newBridge(bridgeConfig{
+			KentIP:       "127.0.0.1",
+			KentPort:     freePort(t),
+			KentServer:   kent.NewKentServer(),
+			Listen:       "127.0.0.1:0",
+			RespTimeout:  time.Hour,
+			SendInterval: time.Hour,
+			QueueSize:    64,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ctx.start(); err != nil {
+			t.Fatalf("start %d: %v", i, err)
+		}
+
+		dev := connectDevice(t, ctx)
+		client := dialBridge(t, ctx, "?devices="+dev.id.String())
+
+		// One request waiting for its report and more queued behind the send interval
+		for n := 0; n < 3; n++ {
+			client.send(t, dev.id, strconv.Itoa(n), &kentpb.SrvToCli{ReqOneof: &kentpb.SrvToCli_EepromRReq{EepromRReq: &kentpb.Empty{}}})
+		}
+		dev.request(t)
+
+		// Stopped straight away or gracefully, the kent server goes either way
+		if i%2 == 0 {
+			err = ctx.stop()
+		} else {
+			sctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			err = ctx.shutdown(sctx)
+			cancel()
+		}
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal(err)
+		}
+		if err := ctx.wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-dev.conn.dropped:
+		case <-time.After(testWait):
+			t.Fatal("the kent server kept the device connected")
+		}
+		if n := ctx.queues.depth(dev.id); n != 0 {
+			t.Fatalf("%d requests still queued", n)
+		}
+		ctx.requests.mutex.Lock()
+		pending := len(ctx.requests.pending)
+		ctx.requests.mutex.Unlock()
+		if pending != 0 {
+			t.Fatalf("requests of %d dispensers still pending", pending)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+/*
+cachedReports - The reports kept per dispenser for clients that subscribe after
+they were sent.
+*/
+var cachedReports = map[string]bool{
+	"DispenserStateRpt": true,
+	"FryerStateRpt":     true,
+	"SnapshotRpt":       true,
+	"EepromRRpt":        true,
+}
+
+/*
+cachedReport - The last report of one type from a dispenser and when it arrived.
+*/
+type cachedReport struct {
+	dispenserID uuid.UUID
+	name        string
+	rpt         *kentpb.CliToSrv
+	at          time.Time
+}
+
+/*
+stateCache - The last cachedReports of every connected dispenser.
+*/
+type stateCache struct {
+	mutex   sync.Mutex
+	reports map[uuid.UUID]map[string]cachedReport
+}
+
+func newStateCache() *stateCache {
+	return &stateCache{
+		reports: make(map[uuid.UUID]map[string]cachedReport),
+	}
+}
+
+/*
+update - Keep a report from a dispenser if it is one of the cachedReports.
+*/
+func (sc *stateCache) update(dispenserID uuid.UUID, rpt *kentpb.CliToSrv) {
+
+	name := reportName(rpt)
+	if !cachedReports[name] {
+		return
+	}
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	reports, ok := sc.reports[dispenserID]
+	if !ok {
+		reports = make(map[string]cachedReport)
+		sc.reports[dispenserID] = reports
+	}
+	reports[name] = cachedReport{
+		dispenserID: dispenserID,
+		name:        name,
+		rpt:         rpt,
+		at:          time.Now(),
+	}
+}
+
+/*
+forget - Drop the reports of a dispenser that went offline.
+*/
+func (sc *stateCache) forget(dispenserID uuid.UUID) {
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	delete(sc.reports, dispenserID)
+}
+
+/*
+get - The cached reports accepted by filter, by dispenser then report name.
+*/
+func (sc *stateCache) get(filter func(dispenserID uuid.UUID, name string) bool) []cachedReport {
+
+	sc.mutex.Lock()
+	var list []cachedReport
+	for id, reports := range sc.reports {
+		for name, r := range reports {
+			if filter(id, name) {
+				list = append(list, r)
+			}
+		}
+	}
+	sc.mutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].dispenserID != list[j].dispenserID {
+			return list[i].dispenserID.String() < list[j].dispenserID.String()
+		}
+		return list[i].name < list[j].name
+	})
+
+	return list
+}
+
+/*
+sendCached - Send a client the cached reports of the dispensers it is subscribed
+to and the reports it watches, or of devices when given, leaving out the reports
+not forwarded to websocket clients. They arrive like any other report with
+CachedAt set to when the dispenser sent them.
+*/
+func (ctx *bridgeCtx) sendCached(client *Client, devices []string) {
+
+	var keep func(dispenserID uuid.UUID, name string) bool
+	if len(devices) > 0 {
+		ids := make(map[uuid.UUID]bool)
+		all := false
+		for _, dev := range devices {
+			if dev == subscribeAll {
+				all = true
+			} else if id, err := uuid.Parse(dev); err == nil {
+				ids[id] = true
+			}
+		}
+		keep = func(dispenserID uuid.UUID, _ string) bool {
+			return all || ids[dispenserID]
+		}
+	} else {
+		all, ids := ctx.cl.subscriptions(client)
+		watched := ctx.cl.watched(client)
+		keep = func(dispenserID uuid.UUID, name string) bool {
+			return all || ids[dispenserID] || watched[name]
+		}
+	}
+
+	cached := ctx.cache.get(func(dispenserID uuid.UUID, name string) bool {
+		return ctx.forwarded[name] && keep(dispenserID, name)
+	})
+	for _, r := range cached {
+		at := r.at
+		p := newReportPayload(wsMsg{ID: r.dispenserID, CachedAt: &at}, r.rpt).forClient(client)
+		if p != nil {
+			client.queue(p)
+		}
+	}
+}
+
+/*
+restState - GET /devices/{id}/state, the cached reports of a dispenser with their
+age in seconds.
+*/
+func (ctx *bridgeCtx) restState(w http.ResponseWriter, r *http.Request, dispenserID uuid.UUID) {
+
+	type stateReport struct {
+		Type     string          `json:"type"`
+		CachedAt time.Time       `json:"cachedAt"`
+		Age      float64         `json:"age"`
+		Report   json.RawMessage `json:"report"`
+	}
+
+	now := time.Now()
+	state := []stateReport{}
+	for _, cr := range ctx.cache.get(func(id uuid.UUID, _ string) bool { return id == dispenserID }) {
+		b, err := protojson.Marshal(cr.rpt)
+		if err != nil {
+			marshalErrors.Add(1)
+			continue
+		}
+		state = append(state, stateReport{
+			Type:     cr.name,
+			CachedAt: cr.at,
+			Age:      now.Sub(cr.at).Seconds(),
+			Report:   b,
+		})
+	}
+
+	restJSON(w, http.StatusOK, state)
+}
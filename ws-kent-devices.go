@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/*
+deviceInfo - Presence details of a dispenser connected to the kent server.
+*/
+type deviceInfo struct {
+	ID          uuid.UUID
+	RemoteAddr  string `json:",omitempty"`
+	ConnectedAt time.Time
+	LastSeen    time.Time
+	Online      bool
+}
+
+/*
+kentAddrServer - Implemented by kent servers able to report the remote address
+of a connected dispenser, not every kent release can.
+*/
+type kentAddrServer interface {
+	RemoteAddr(dispenserID uuid.UUID) net.Addr
+}
+
+/*
+deviceRegistry - The dispensers currently connected to the kent server.
+*/
+type deviceRegistry struct {
+	mutex   sync.Mutex
+	devices map[uuid.UUID]*deviceInfo
+}
+
+func newDeviceRegistry() *deviceRegistry {
+	return &deviceRegistry{
+		devices: make(map[uuid.UUID]*deviceInfo),
+	}
+}
+
+/*
+online - Record a dispenser connecting and return its presence details.
+*/
+func (reg *deviceRegistry) online(dispenserID uuid.UUID, remoteAddr string) deviceInfo {
+
+	now := time.Now()
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	dev := &deviceInfo{
+		ID:          dispenserID,
+		RemoteAddr:  remoteAddr,
+		ConnectedAt: now,
+		LastSeen:    now,
+		Online:      true,
+	}
+	reg.devices[dispenserID] = dev
+
+	return *dev
+}
+
+/*
+offline - Remove a dispenser from the registry and return its last presence details.
+*/
+func (reg *deviceRegistry) offline(dispenserID uuid.UUID) deviceInfo {
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	dev, ok := reg.devices[dispenserID]
+	if !ok {
+		return deviceInfo{ID: dispenserID}
+	}
+	delete(reg.devices, dispenserID)
+
+	dev.Online = false
+	return *dev
+}
+
+/*
+seen - Update the last seen time of a dispenser when it sends a report. Reports
+from dispensers that connected before ws-kent started registering them also add
+them to the registry.
+*/
+func (reg *deviceRegistry) seen(dispenserID uuid.UUID) (dev deviceInfo, added bool) {
+
+	now := time.Now()
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	d, ok := reg.devices[dispenserID]
+	if !ok {
+		d = &deviceInfo{
+			ID:          dispenserID,
+			ConnectedAt: now,
+			Online:      true,
+		}
+		reg.devices[dispenserID] = d
+	}
+	d.LastSeen = now
+
+	return *d, !ok
+}
+
+/*
+isOnline - Whether the dispenser is currently connected.
+*/
+func (reg *deviceRegistry) isOnline(dispenserID uuid.UUID) bool {
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	_, ok := reg.devices[dispenserID]
+	return ok
+}
+
+/*
+snapshot - The presence details of every connected dispenser, ordered by connect time.
+*/
+func (reg *deviceRegistry) snapshot() []deviceInfo {
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	list := make([]deviceInfo, 0, len(reg.devices))
+	for _, dev := range reg.devices {
+		list = append(list, *dev)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ConnectedAt.Before(list[j].ConnectedAt)
+	})
+
+	return list
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"kent-control-interface/kentcontrol"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+gRPC control service for backend services, requests go through the same queues,
+audit log and report correlation as the websocket ones. The KentControl service
+and its messages are in kentcontrol/kentcontrol.proto, next to the code generated
+from it. Kent requests and reports travel in them serialized.
+
+Server reflection is on, so grpcurl and friends can fetch the descriptor from
+ws-kent. With an auth file, calls carry a token in "authorization: Bearer <token>"
+metadata.
+*/
+
+/*
+grpcControl - The KentControl service of a bridge.
+*/
+type grpcControl struct {
+	kentcontrol.UnimplementedKentControlServer
+	ctx *bridgeCtx
+}
+
+func (gc grpcControl) Send(sctx context.Context, in *kentcontrol.DeviceCommand) (*kentcontrol.DeviceReport, error) {
+	return gc.ctx.grpcSend(sctx, in)
+}
+
+func (gc grpcControl) Subscribe(in *kentcontrol.DeviceFilter, stream kentcontrol.KentControl_SubscribeServer) error {
+	return gc.ctx.grpcSubscribe(in, stream)
+}
+
+/*
+newGRPCServer - The gRPC server of the bridge, serving TLS when ws-kent has a
+certificate.
+*/
+func (ctx *bridgeCtx) newGRPCServer() (*grpc.Server, error) {
+
+	var opts []grpc.ServerOption
+	if ctx.cfg.TLSCert != "" {
+		creds, err := credentials.NewServerTLSFromFile(ctx.cfg.TLSCert, ctx.cfg.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+
+	srv := grpc.NewServer(opts...)
+	kentcontrol.RegisterKentControlServer(srv, grpcControl{ctx: ctx})
+	reflection.Register(srv)
+
+	return srv, nil
+}
+
+/*
+grpcClient - A local client for a gRPC call, as the operator whose token is in the
+call's metadata when ws-kent runs with an auth file.
+*/
+func (ctx *bridgeCtx) grpcClient(sctx context.Context) (*Client, error) {
+
+	op := anonymousOperator
+	if ctx.auth != nil {
+		md, _ := metadata.FromIncomingContext(sctx)
+		token := ""
+		if values := md.Get("authorization"); len(values) > 0 {
+			token = strings.TrimPrefix(values[0], "Bearer ")
+		}
+
+		var err error
+		if op, err = ctx.auth.tokenOperator(token); err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+	}
+
+	remoteAddr := ""
+	if p, ok := peer.FromContext(sctx); ok {
+		remoteAddr = p.Addr.String()
+	}
+
+	return newLocalClient(op, remoteAddr), nil
+}
+
+/*
+grpcSend - KentControl.Send, queue a request for a dispenser and return the report
+answering it, or a DeviceReport without one once it is delivered if it has none.
+*/
+func (ctx *bridgeCtx) grpcSend(sctx context.Context, in *kentcontrol.DeviceCommand) (*kentcontrol.DeviceReport, error) {
+
+	dispenserID, err := uuid.Parse(in.GetDispenserId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid dispenser ID")
+	}
+
+	req := &kentpb.SrvToCli{}
+	if err := proto.Unmarshal(in.GetReq(), req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "decoding request: "+err.Error())
+	}
+
+	client, err := ctx.grpcClient(sctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.close()
+
+	msg := wsMsg{
+		ID:    dispenserID,
+		ReqID: uuid.New().String(),
+	}
+
+	err = ctx.admit(client, msg, req)
+	ctx.audit.record(client, msg, req, err)
+	if err != nil {
+		code := codes.Unavailable
+		if errors.Is(err, errForbidden) {
+			code = codes.PermissionDenied
+		} else if errors.Is(err, errDeviceOffline) {
+			code = codes.NotFound
+		}
+		return nil, status.Error(code, err.Error())
+	}
+
+	reply, ok := client.awaitReply(sctx.Done(), msg.ReqID)
+	if !ok {
+		return nil, status.FromContextError(sctx.Err()).Err()
+	}
+
+	switch {
+	case reply.Type == wsMsgAck && reply.Error != "":
+		return nil, status.Error(codes.Unavailable, reply.Error)
+	case reply.Type == wsMsgTimeout:
+		return nil, status.Error(codes.DeadlineExceeded, reply.Error)
+	}
+
+	out := &kentcontrol.DeviceReport{DispenserId: dispenserID.String()}
+	if len(reply.Msg) > 0 {
+		rpt := &kentpb.CliToSrv{}
+		if err := protojson.Unmarshal(reply.Msg, rpt); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if out.Rpt, err = proto.Marshal(rpt); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return out, nil
+}
+
+/*
+grpcSubscribe - KentControl.Subscribe, stream the reports of the dispensers in the
+filter until the caller goes away or ws-kent stops.
+*/
+func (ctx *bridgeCtx) grpcSubscribe(in *kentcontrol.DeviceFilter, stream kentcontrol.KentControl_SubscribeServer) error {
+
+	devices := in.GetDispenserIds()
+	if len(devices) == 0 {
+		devices = []string{subscribeAll}
+	}
+
+	known := make(map[string]bool)
+	for _, rpt := range kentReports() {
+		known[rptName(rpt)] = true
+	}
+	reports := make(map[string]bool)
+	for _, name := range in.GetReports() {
+		if !known[name] {
+			return status.Errorf(codes.InvalidArgument, "unknown report %q", name)
+		}
+		reports[name] = true
+	}
+
+	client, err := ctx.grpcClient(stream.Context())
+	if err != nil {
+		return err
+	}
+	if err := ctx.cl.subscribe(client, devices); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	log.Println("gRPC subscriber", client.RemoteAddr, "as", client.Operator.name, "total clients:", ctx.cl.add(client))
+	defer func() {
+		ctx.cl.remove(client)
+		client.close()
+	}()
+
+	forward := func(p []byte) error {
+		msg, rpt, ok := decodeReport(p)
+		if !ok {
+			return nil
+		}
+		if len(reports) > 0 && !reports[reportName(rpt)] {
+			return nil
+		}
+
+		b, err := proto.Marshal(rpt)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return stream.Send(&kentcontrol.DeviceReport{
+			DispenserId: msg.ID.String(),
+			Rpt:         b,
+		})
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-client.done:
+			return status.Error(codes.ResourceExhausted, "subscriber is not keeping up")
+		case <-client.quit:
+			// Send what is left before ws-kent stops
+			for {
+				select {
+				case p := <-client.send:
+					if err := forward(p); err != nil {
+						return err
+					}
+				default:
+					return nil
+				}
+			}
+		case p := <-client.send:
+			if err := forward(p); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+/*
+decodeReport - The report in a message queued for a local client, false for other
+messages.
+*/
+func decodeReport(p []byte) (wsMsg, *kentpb.CliToSrv, bool) {
+
+	var msg wsMsg
+	if err := json.Unmarshal(p, &msg); err != nil || msg.Type != wsMsgKent || len(msg.Msg) == 0 {
+		return msg, nil, false
+	}
+
+	rpt := &kentpb.CliToSrv{}
+	if err := protojson.Unmarshal(msg.Msg, rpt); err != nil || oneofType(rpt) == nil {
+		return msg, nil, false
+	}
+
+	return msg, rpt, true
+}
+
+/*
+startGRPC - Listen for gRPC calls on addr, its errors end up in errc like the
+websocket server's.
+*/
+func (ctx *bridgeCtx) startGRPC(addr string) error {
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("gRPC server is running:", listener.Addr().String())
+	ctx.grpcListener = listener
+	go func() {
+		ctx.errc <- ctx.grpcSrv.Serve(listener)
+	}()
+
+	return nil
+}
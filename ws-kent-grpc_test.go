@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"kent-control-interface/kentcontrol"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestGRPCSendAndSubscribe(t *testing.T) {
+
+	ctx := startBridge(t, bridgeConfig{GRPCListen: "127.0.0.1:0"})
+	dev := connectDevice(t, ctx)
+
+	conn, err := grpc.Dial(ctx.grpcListener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	control := kentcontrol.NewKentControlClient(conn)
+
+	sctx, cancel := context.WithTimeout(context.Background(), testWait)
+	defer cancel()
+
+	stream, err := control.Subscribe(sctx, &kentcontrol.DeviceFilter{
+		DispenserIds: []string{dev.id.String()},
+		Reports:      []string{"LogRpt"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, testWait, "the subscriber", func() bool {
+		return ctx.cl.count() == 1
+	})
+
+	// Send waits for the report answering the request
+	type sent struct {
+		rpt *kentcontrol.DeviceReport
+		err error
+	}
+	result := make(chan sent, 1)
+	req, err := proto.Marshal(&kentpb.SrvToCli{ReqOneof: &kentpb.SrvToCli_EepromRReq{EepromRReq: &kentpb.Empty{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		rpt, err := control.Send(sctx, &kentcontrol.DeviceCommand{
+			DispenserId: dev.id.String(),
+			Req:         req,
+		})
+		result <- sent{rpt, err}
+	}()
+
+	if got := dev.request(t); reqName(got) != "EepromRReq" {
+		t.Fatalf("the device got %s", reqName(got))
+	}
+	answer := reportOf(t, reflect.TypeOf(&kentpb.CliToSrv_EepromRRpt{}))
+	dev.report(t, answer)
+	r := <-result
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if got := decodeCliToSrv(t, r.rpt.GetRpt()); !proto.Equal(got, answer) {
+		t.Fatalf("Send returned %v", got)
+	}
+
+	// Only the reports in the filter are streamed
+	log := &kentpb.CliToSrv{RptOneof: &kentpb.CliToSrv_LogRpt{LogRpt: &kentpb.LogReport{Msg: "hello"}}}
+	dev.report(t, log)
+	got, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GetDispenserId() != dev.id.String() || !proto.Equal(decodeCliToSrv(t, got.GetRpt()), log) {
+		t.Fatalf("Subscribe streamed %v", got)
+	}
+
+	_, err = control.Send(sctx, &kentcontrol.DeviceCommand{DispenserId: "not a uuid"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Send to an invalid dispenser ID: %v", err)
+	}
+	_, err = control.Send(sctx, &kentcontrol.DeviceCommand{DispenserId: dev.id.String(), Req: []byte{0xff}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Send of an invalid request: %v", err)
+	}
+}
+
+func decodeCliToSrv(t *testing.T, b []byte) *kentpb.CliToSrv {
+	t.Helper()
+
+	rpt := &kentpb.CliToSrv{}
+	if err := proto.Unmarshal(b, rpt); err != nil {
+		t.Fatal(err)
+	}
+	return rpt
+}
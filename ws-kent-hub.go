@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to write a message to a client.
+	writeWait = 10 * time.Second
+
+	// Largest message accepted from a client.
+	maxMessageSize = 64 * 1024
+
+	// Messages buffered per client before it is dropped as a slow consumer.
+	sendBufferSize = 256
+)
+
+// The keepalive timings are variables so the tests can shorten them.
+var (
+	// Time allowed to read the next pong from a client.
+	pongWait = 60 * time.Second
+
+	// Pings are sent well within pongWait so an idle client is not timed out.
+	pingPeriod = (pongWait * 9) / 10
+)
+
+/*
+ClientList - The list of clinets currently connected to the websocket server.
+*/
+type ClientList struct {
+	mutex   sync.Mutex
+	Clients map[string]*Client
+}
+
+/*
+Client - To store each individual client's ID, web socket connection, operator and
+the dispensers it wants reports from. Messages for the client are buffered in send
+and written by the client's own writer goroutine.
+*/
+type Client struct {
+	ID         string
+	Connection *websocket.Conn
+	RemoteAddr string
+	Operator   operator
+	send       chan []byte
+	done       chan struct{}
+	closeOnce  sync.Once
+	quit       chan struct{}
+	quitOnce   sync.Once
+	all        bool
+	devices    map[uuid.UUID]bool
+	reports    map[string]bool
+	protojson  bool
+}
+
+func newClientList() *ClientList {
+	return &ClientList{
+		Clients: make(map[string]*Client),
+	}
+}
+
+/*
+newLocalClient - A client without a websocket connection, for requests made over
+other APIs. Its messages are read from send, as protojson.
+*/
+func newLocalClient(op operator, remoteAddr string) *Client {
+	return &Client{
+		ID:         uuid.New().String(),
+		RemoteAddr: remoteAddr,
+		Operator:   op,
+		send:       make(chan []byte, sendBufferSize),
+		done:       make(chan struct{}),
+		quit:       make(chan struct{}),
+		protojson:  true,
+	}
+}
+
+/*
+awaitReply - Wait for the last message a local client gets for request reqID: its
+report, its timeout, or its ack when there is no report to wait for. Returns false
+if done is closed first.
+*/
+func (client *Client) awaitReply(done <-chan struct{}, reqID string) (wsMsg, bool) {
+	for {
+		select {
+		case <-done:
+			return wsMsg{}, false
+		case p := <-client.send:
+			var reply wsMsg
+			if err := json.Unmarshal(p, &reply); err != nil || reply.ReqID != reqID {
+				continue
+			}
+			if reply.Type == wsMsgAck && reply.Error == "" && reply.Awaiting != "" {
+				continue
+			}
+			return reply, true
+		}
+	}
+}
+
+func newClient(conn *websocket.Conn, op operator) *Client {
+	return &Client{
+		ID:         uuid.New().String(),
+		Connection: conn,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Operator:   op,
+		send:       make(chan []byte, sendBufferSize),
+		done:       make(chan struct{}),
+		quit:       make(chan struct{}),
+	}
+}
+
+/*
+add - To add a client to the list when they connect, returns the number of clients.
+*/
+func (cl *ClientList) add(client *Client) int {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	cl.Clients[client.ID] = client
+	return len(cl.Clients)
+}
+
+/*
+remove - To remove a client from the list when they disconnect, returns the number of clients.
+*/
+func (cl *ClientList) remove(client *Client) int {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	delete(cl.Clients, client.ID)
+	return len(cl.Clients)
+}
+
+/*
+count - The number of connected clients.
+*/
+func (cl *ClientList) count() int {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	return len(cl.Clients)
+}
+
+/*
+closeAll - Disconnect every client.
+*/
+func (cl *ClientList) closeAll() {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	for _, client := range cl.Clients {
+		client.close()
+	}
+}
+
+/*
+shutdownAll - Send every client what is still queued for it followed by a close
+frame, and wait for them to disconnect until ctx is done.
+*/
+func (cl *ClientList) shutdownAll(ctx context.Context) {
+
+	cl.mutex.Lock()
+	for _, client := range cl.Clients {
+		client.shutdown()
+	}
+	cl.mutex.Unlock()
+
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	for cl.count() > 0 {
+		select {
+		case <-ctx.Done():
+			cl.closeAll()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+subscribe - Replace the client's subscriptions with the given dispenser IDs,
+subscribeAll matches every dispenser.
+*/
+func (cl *ClientList) subscribe(client *Client, devices []string) error {
+
+	all := false
+	ids := make(map[uuid.UUID]bool)
+	for _, dev := range devices {
+		if dev == subscribeAll {
+			all = true
+			continue
+		}
+		id, err := uuid.Parse(dev)
+		if err != nil {
+			return fmt.Errorf("invalid dispenser ID %q: %w", dev, err)
+		}
+		ids[id] = true
+	}
+
+	cl.mutex.Lock()
+	client.all = all
+	client.devices = ids
+	cl.mutex.Unlock()
+
+	return nil
+}
+
+/*
+watch - Replace the reports the client gets from every dispenser on top of its
+subscriptions, e.g. FryerStateRpt for a dashboard. Reports are named like
+EepromRRpt.
+*/
+func (cl *ClientList) watch(client *Client, reports []string) error {
+
+	known := make(map[string]bool)
+	for _, rpt := range kentReports() {
+		known[rptName(rpt)] = true
+	}
+
+	watched := make(map[string]bool)
+	for _, name := range reports {
+		if !known[name] {
+			return fmt.Errorf("unknown report %q", name)
+		}
+		watched[name] = true
+	}
+
+	cl.mutex.Lock()
+	client.reports = watched
+	cl.mutex.Unlock()
+
+	return nil
+}
+
+/*
+watched - The reports the client gets from every dispenser.
+*/
+func (cl *ClientList) watched(client *Client) map[string]bool {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	reports := make(map[string]bool, len(client.reports))
+	for name := range client.reports {
+		reports[name] = true
+	}
+	return reports
+}
+
+/*
+subscriptions - Whether the client is subscribed to every dispenser and the ones
+it is subscribed to otherwise.
+*/
+func (cl *ClientList) subscriptions(client *Client) (bool, map[uuid.UUID]bool) {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	ids := make(map[uuid.UUID]bool, len(client.devices))
+	for id := range client.devices {
+		ids[id] = true
+	}
+	return client.all, ids
+}
+
+/*
+broadcast - Queue a message for every client accepted by filter, or every client
+when filter is nil.
+*/
+func (cl *ClientList) broadcast(p []byte, filter func(client *Client) bool) {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	for _, client := range cl.Clients {
+		if filter == nil || filter(client) {
+			client.queue(p)
+		}
+	}
+}
+
+/*
+broadcastEach - Queue the message payload returns for each client, clients it
+returns nil for are skipped. payload is called with the mutex held.
+*/
+func (cl *ClientList) broadcastEach(payload func(client *Client) []byte) {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	for _, client := range cl.Clients {
+		if p := payload(client); p != nil {
+			client.queue(p)
+		}
+	}
+}
+
+/*
+isSubscribed - Whether reports from dispenserID should be forwarded to the client.
+The client list mutex must be held.
+*/
+func (client *Client) isSubscribed(dispenserID uuid.UUID) bool {
+	return client.all || client.devices[dispenserID]
+}
+
+/*
+wants - Whether a report from dispenserID should be forwarded to the client,
+because it is subscribed to the dispenser or watches the report. The client list
+mutex must be held.
+*/
+func (client *Client) wants(dispenserID uuid.UUID, report string) bool {
+	return client.isSubscribed(dispenserID) || client.reports[report]
+}
+
+/*
+queue - Buffer a message for the client's writer. A client whose buffer is full
+is not keeping up and gets disconnected rather than stalling everybody else.
+*/
+func (client *Client) queue(p []byte) bool {
+	select {
+	case <-client.done:
+		return false
+	default:
+	}
+
+	select {
+	case client.send <- p:
+		return true
+	default:
+		log.Println("dropping slow client", client.ID)
+		client.close()
+		return false
+	}
+}
+
+/*
+close - Stop the client's writer and close its connection, safe to call more than once.
+*/
+func (client *Client) close() {
+	client.closeOnce.Do(func() {
+		close(client.done)
+		if client.Connection != nil {
+			client.Connection.Close()
+		}
+	})
+}
+
+/*
+shutdown - Ask the client's writer to flush its messages and close the connection
+with a going away close frame.
+*/
+func (client *Client) shutdown() {
+	client.quitOnce.Do(func() {
+		close(client.quit)
+	})
+}
+
+/*
+writePump - The only goroutine writing to the client's connection. Sends queued
+messages and pings to keep the connection alive.
+*/
+func (client *Client) writePump() {
+
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		client.close()
+	}()
+
+	for {
+		select {
+		case <-client.done:
+			return
+		case p := <-client.send:
+			client.Connection.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := client.Connection.WriteMessage(websocket.TextMessage, p); err != nil {
+				return
+			}
+		case <-ticker.C:
+			client.Connection.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := client.Connection.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-client.quit:
+			client.flush()
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "ws-kent is shutting down")
+			client.Connection.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+
+			// Wait for the browser to answer the close frame before closing
+			select {
+			case <-client.done:
+			case <-time.After(writeWait):
+			}
+			return
+		}
+	}
+}
+
+/*
+flush - Write the messages still queued for the client.
+*/
+func (client *Client) flush() {
+	for {
+		select {
+		case p := <-client.send:
+			client.Connection.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := client.Connection.WriteMessage(websocket.TextMessage, p); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
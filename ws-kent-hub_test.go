@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+/*
+hubServer - A bridge that isn't started, its websocket handler served by a test
+server. Clients are disconnected when the test ends.
+*/
+func hubServer(t *testing.T) (*bridgeCtx, string) {
+	t.Helper()
+
+	ctx, err := newBridge(bridgeConfig{
+		RespTimeout:  time.Second,
+		SendInterval: time.Millisecond,
+		QueueSize:    16,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(ctx.wsSrv)
+	t.Cleanup(func() {
+		ctx.cl.closeAll()
+		waitFor(t, 5*time.Second, "the clients to disconnect", func() bool {
+			return ctx.cl.count() == 0
+		})
+		srv.Close()
+	})
+
+	return ctx, "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+/*
+waitFor - Poll cond until it holds, failing the test after timeout.
+*/
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHubConcurrentAddRemoveBroadcast(t *testing.T) {
+
+	cl := newClientList()
+	dispenserID := uuid.New()
+
+	stop := make(chan struct{})
+	var broadcasters sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		broadcasters.Add(1)
+		go func() {
+			defer broadcasters.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-time.After(100 * time.Microsecond):
+				}
+				cl.broadcast([]byte("presence"), nil)
+				cl.broadcastEach(func(client *Client) []byte {
+					if !client.isSubscribed(dispenserID) {
+						return nil
+					}
+					return []byte("report")
+				})
+				cl.count()
+			}
+		}()
+	}
+
+	var clients sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			for n := 0; n < 200; n++ {
+				client := newLocalClient(anonymousOperator, "test")
+				cl.add(client)
+
+				devices := []string{dispenserID.String()}
+				if n%2 == 0 {
+					devices = []string{subscribeAll}
+				}
+				if err := cl.subscribe(client, devices); err != nil {
+					t.Error(err)
+					return
+				}
+				cl.subscriptions(client)
+
+				for drained := 0; drained < 4; drained++ {
+					select {
+					case <-client.send:
+					case <-client.done:
+					case <-time.After(time.Millisecond):
+					}
+				}
+
+				cl.remove(client)
+				client.close()
+				client.close()
+			}
+		}()
+	}
+
+	clients.Wait()
+	close(stop)
+	broadcasters.Wait()
+
+	if n := cl.count(); n != 0 {
+		t.Fatalf("%d clients left in the list", n)
+	}
+}
+
+func TestHubConcurrentWebsocketClients(t *testing.T) {
+
+	ctx, url := hubServer(t)
+	dispenserID := uuid.New()
+	report := &kentpb.CliToSrv{
+		RptOneof: &kentpb.CliToSrv_LogRpt{LogRpt: &kentpb.LogReport{Msg: "hello"}},
+	}
+
+	stop := make(chan struct{})
+	var broadcasters sync.WaitGroup
+	broadcasters.Add(2)
+	go func() {
+		defer broadcasters.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			ctx.kentMsgHandler(dispenserID, report)
+		}
+	}()
+	go func() {
+		defer broadcasters.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			ctx.onKentDispenserOnline(dispenserID)
+			ctx.onKentDispenserDisconn(dispenserID)
+		}
+	}()
+
+	var clients sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			for n := 0; n < 10; n++ {
+				conn, _, err := websocket.DefaultDialer.Dial(url+"?devices="+dispenserID.String(), nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				conn.WriteJSON(wsMsg{Type: wsMsgSubscribe, Devices: []string{subscribeAll}})
+				for read := 0; read < 3; read++ {
+					conn.SetReadDeadline(time.Now().Add(time.Second))
+					if _, _, err := conn.ReadMessage(); err != nil {
+						break
+					}
+				}
+				conn.Close()
+			}
+		}()
+	}
+
+	clients.Wait()
+	close(stop)
+	broadcasters.Wait()
+
+	waitFor(t, 5*time.Second, "every client to be removed", func() bool {
+		return ctx.cl.count() == 0
+	})
+}
+
+func TestHubDropsSlowConsumer(t *testing.T) {
+
+	cl := newClientList()
+	slow := newLocalClient(anonymousOperator, "slow")
+	fast := newLocalClient(anonymousOperator, "fast")
+	cl.add(slow)
+	cl.add(fast)
+
+	// The slow client's buffer fills up, the next message drops it
+	for i := 0; i <= sendBufferSize; i++ {
+		cl.broadcast([]byte("report"), nil)
+
+		select {
+		case <-fast.send:
+		case <-fast.done:
+			t.Fatalf("fast client dropped after %d messages", i)
+		}
+	}
+
+	select {
+	case <-slow.done:
+	default:
+		t.Fatal("slow client was not dropped")
+	}
+	if slow.queue([]byte("report")) {
+		t.Fatal("a dropped client still accepts messages")
+	}
+	if !fast.queue([]byte("report")) {
+		t.Fatal("fast client no longer accepts messages")
+	}
+}
+
+func TestHubDropsSlowWebsocketClient(t *testing.T) {
+
+	ctx, url := hubServer(t)
+
+	// Never reads, its socket buffers fill up and then its send buffer
+	slow, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+
+	fast, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	go func() {
+		for {
+			if _, _, err := fast.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	waitFor(t, time.Second, "both clients to connect", func() bool {
+		return ctx.cl.count() == 2
+	})
+
+	payload := bytes.Repeat([]byte("x"), 32*1024)
+	deadline := time.Now().Add(20 * time.Second)
+	for ctx.cl.count() == 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("slow client was not dropped")
+		}
+		ctx.cl.broadcast(payload, nil)
+		time.Sleep(time.Millisecond)
+	}
+
+	// The fast client is still served
+	if n := ctx.cl.count(); n != 1 {
+		t.Fatalf("%d clients left, want the fast one", n)
+	}
+	ctx.cl.broadcast([]byte(`{"Type":"presence"}`), nil)
+}
+
+/*
+shortKeepalive - Ping every period and time clients out without a pong for
+twice that, for the rest of the test.
+*/
+func shortKeepalive(t *testing.T, period time.Duration) {
+
+	prevWait, prevPeriod := pongWait, pingPeriod
+	pongWait, pingPeriod = 2*period, period
+	t.Cleanup(func() {
+		pongWait, pingPeriod = prevWait, prevPeriod
+	})
+}
+
+func TestHubKeepsAnsweringClient(t *testing.T) {
+
+	shortKeepalive(t, 50*time.Millisecond)
+	ctx, url := hubServer(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var pingsMutex sync.Mutex
+	pings := 0
+	conn.SetPingHandler(func(data string) error {
+		pingsMutex.Lock()
+		pings++
+		pingsMutex.Unlock()
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Several times the pong wait
+	time.Sleep(10 * pingPeriod)
+
+	if n := ctx.cl.count(); n != 1 {
+		t.Fatalf("client answering pings was disconnected, %d clients", n)
+	}
+	pingsMutex.Lock()
+	defer pingsMutex.Unlock()
+	if pings < 5 {
+		t.Fatalf("got %d pings in %s, want at least 5", pings, 10*pingPeriod)
+	}
+}
+
+func TestHubTimesOutSilentClient(t *testing.T) {
+
+	shortKeepalive(t, 50*time.Millisecond)
+	ctx, url := hubServer(t)
+
+	// Never reads, so never answers the pings
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	waitFor(t, time.Second, "the client to connect", func() bool {
+		return ctx.cl.count() == 1
+	})
+	waitFor(t, 10*pongWait, "the silent client to time out", func() bool {
+		return ctx.cl.count() == 0
+	})
+}
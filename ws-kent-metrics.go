@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+/*
+metricReports - The reports whose fields are exported as gauges, per dispenser and
+per idx for reports that have one, ex: kent_dbg_scale_read_resp_weight_mg.
+*/
+var metricReports = map[string]bool{
+	"FryerStateRpt":     true,
+	"DispenserStateRpt": true,
+	"DbgScaleReadResp":  true,
+}
+
+// marshalErrors counts the messages that could not be encoded for a client.
+var marshalErrors atomic.Uint64
+
+/*
+deviceGauge - One field of a report exported as a gauge.
+*/
+type deviceGauge struct {
+	name   string
+	device uuid.UUID
+	idx    string
+}
+
+/*
+bridgeMetrics - Counters of the traffic through the bridge and the last values of
+the metricReports, served in the Prometheus text format on /metrics.
+*/
+type bridgeMetrics struct {
+	mutex      sync.Mutex
+	reports    map[string]uint64
+	requests   map[string]uint64
+	sendErrors map[string]uint64
+	gauges     map[deviceGauge]float64
+}
+
+func newBridgeMetrics() *bridgeMetrics {
+	return &bridgeMetrics{
+		reports:    make(map[string]uint64),
+		requests:   make(map[string]uint64),
+		sendErrors: make(map[string]uint64),
+		gauges:     make(map[deviceGauge]float64),
+	}
+}
+
+/*
+report - Count a report from a dispenser and keep its values if it is one of the
+metricReports.
+*/
+func (bm *bridgeMetrics) report(dispenserID uuid.UUID, rpt *kentpb.CliToSrv) {
+
+	name := reportName(rpt)
+
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+
+	bm.reports[name]++
+
+	if !metricReports[name] {
+		return
+	}
+
+	// The report is the message field set in the CliToSrv oneof
+	m := rpt.ProtoReflect()
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.ContainingOneof() == nil || fd.Message() == nil {
+			return true
+		}
+
+		fields := fd.Message().Fields()
+		values := v.Message()
+
+		idx := ""
+		if f := fields.ByName("idx"); f != nil {
+			idx = strconv.FormatUint(values.Get(f).Uint(), 10)
+		}
+
+		// Every field is read, Range would skip the ones at zero
+		for i := 0; i < fields.Len(); i++ {
+			f := fields.Get(i)
+			if f.Name() == "idx" || f.IsList() || f.IsMap() {
+				continue
+			}
+			if value, ok := gaugeValue(f, values.Get(f)); ok {
+				bm.gauges[deviceGauge{
+					name:   "kent_" + string(fd.Name()) + "_" + string(f.Name()),
+					device: dispenserID,
+					idx:    idx,
+				}] = value
+			}
+		}
+		return false
+	})
+}
+
+/*
+gaugeValue - A scalar field of a report as a gauge value, false for fields that
+aren't numbers, booleans or enums.
+*/
+func gaugeValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) (float64, bool) {
+
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		if v.Bool() {
+			return 1, true
+		}
+		return 0, true
+	case protoreflect.EnumKind:
+		return float64(v.Enum()), true
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return float64(v.Int()), true
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return float64(v.Uint()), true
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return v.Float(), true
+	}
+
+	return 0, false
+}
+
+/*
+sent - Count a request passed on to a dispenser, or that failed to be when err is set.
+*/
+func (bm *bridgeMetrics) sent(req *kentpb.SrvToCli, err error) {
+
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+
+	if err != nil {
+		bm.sendErrors[reqName(req)]++
+	} else {
+		bm.requests[reqName(req)]++
+	}
+}
+
+/*
+forget - Drop the report values of a dispenser that went offline.
+*/
+func (bm *bridgeMetrics) forget(dispenserID uuid.UUID) {
+
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+
+	for g := range bm.gauges {
+		if g.device == dispenserID {
+			delete(bm.gauges, g)
+		}
+	}
+}
+
+/*
+metricsHandler - GET /metrics, the bridge and device metrics in the Prometheus
+text format.
+*/
+func (ctx *bridgeCtx) metricsHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	devices := ctx.devices.snapshot()
+
+	writeMetric(w, "ws_kent_devices_connected", "gauge", "Dispensers connected to the kent server.")
+	fmt.Fprintf(w, "ws_kent_devices_connected %d\n", len(devices))
+
+	writeMetric(w, "ws_kent_device_last_seen_seconds", "gauge", "Unix time of the last report from each dispenser.")
+	for _, dev := range devices {
+		fmt.Fprintf(w, "ws_kent_device_last_seen_seconds{device=%q} %d\n", dev.ID.String(), dev.LastSeen.Unix())
+	}
+
+	writeMetric(w, "ws_kent_clients", "gauge", "Connected websocket and gRPC subscribers.")
+	fmt.Fprintf(w, "ws_kent_clients %d\n", ctx.cl.count())
+
+	writeMetric(w, "ws_kent_queue_depth", "gauge", "Requests waiting to be sent to each dispenser.")
+	depths := ctx.queues.depths()
+	for _, dev := range devices {
+		fmt.Fprintf(w, "ws_kent_queue_depth{device=%q} %d\n", dev.ID.String(), depths[dev.ID])
+	}
+
+	writeMetric(w, "ws_kent_marshal_errors_total", "counter", "Messages that could not be encoded for a client.")
+	fmt.Fprintf(w, "ws_kent_marshal_errors_total %d\n", marshalErrors.Load())
+
+	ctx.metrics.mutex.Lock()
+	defer ctx.metrics.mutex.Unlock()
+
+	writeMetric(w, "ws_kent_messages_in_total", "counter", "Reports received from the dispensers per type.")
+	writeCounters(w, "ws_kent_messages_in_total", ctx.metrics.reports)
+
+	writeMetric(w, "ws_kent_messages_out_total", "counter", "Requests sent to the dispensers per type.")
+	writeCounters(w, "ws_kent_messages_out_total", ctx.metrics.requests)
+
+	writeMetric(w, "ws_kent_send_errors_total", "counter", "Requests that failed to be sent to a dispenser per type.")
+	writeCounters(w, "ws_kent_send_errors_total", ctx.metrics.sendErrors)
+
+	gauges := make([]deviceGauge, 0, len(ctx.metrics.gauges))
+	for g := range ctx.metrics.gauges {
+		gauges = append(gauges, g)
+	}
+	sort.Slice(gauges, func(i, j int) bool {
+		if gauges[i].name != gauges[j].name {
+			return gauges[i].name < gauges[j].name
+		}
+		if gauges[i].device != gauges[j].device {
+			return gauges[i].device.String() < gauges[j].device.String()
+		}
+		return gauges[i].idx < gauges[j].idx
+	})
+
+	last := ""
+	for _, g := range gauges {
+		if g.name != last {
+			writeMetric(w, g.name, "gauge", "Last value reported by the dispensers.")
+			last = g.name
+		}
+		labels := fmt.Sprintf("device=%q", g.device.String())
+		if g.idx != "" {
+			labels += fmt.Sprintf(",idx=%q", g.idx)
+		}
+		fmt.Fprintf(w, "%s{%s} %s\n", g.name, labels, strconv.FormatFloat(ctx.metrics.gauges[g], 'g', -1, 64))
+	}
+}
+
+func writeMetric(w io.Writer, name string, typ string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeCounters(w io.Writer, name string, counts map[string]uint64) {
+
+	types := make([]string, 0, len(counts))
+	for typ := range counts {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	for _, typ := range types {
+		fmt.Fprintf(w, "%s{type=%q} %d\n", name, typ, counts[typ])
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+
+	"github.com/google/uuid"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+mqttMessage - A message published on the test broker.
+*/
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+/*
+startBroker - An embedded MQTT broker that lets anyone in, closed when the test
+ends. Everything published under kent/ is handed to the test.
+*/
+func startBroker(t *testing.T) (*mochi.Server, string, <-chan mqttMessage) {
+	t.Helper()
+
+	broker := mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := broker.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := "127.0.0.1:" + freePort(t)
+	if err := broker.AddListener(listeners.NewTCP("tcp", addr, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		broker.Close()
+	})
+
+	msgs := make(chan mqttMessage, 64)
+	err := broker.Subscribe(mqttTopicRoot+"/#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		msgs <- mqttMessage{pk.TopicName, pk.Payload}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return broker, "tcp://" + addr, msgs
+}
+
+/*
+expectMQTT - Wait for a message on topic, failing the test after testWait.
+*/
+func expectMQTT(t *testing.T, msgs <-chan mqttMessage, topic string) []byte {
+	t.Helper()
+
+	timeout := time.After(testWait)
+	for {
+		select {
+		case m := <-msgs:
+			if m.topic == topic {
+				return m.payload
+			}
+		case <-timeout:
+			t.Fatalf("nothing published on %s", topic)
+			return nil
+		}
+	}
+}
+
+func TestMQTTBridge(t *testing.T) {
+
+	broker, uri, msgs := startBroker(t)
+	ctx := startBridge(t, bridgeConfig{MQTTBroker: uri, MQTTClientID: "ws-kent-test"})
+	dev := connectDevice(t, ctx)
+
+	waitFor(t, testWait, "ws-kent to subscribe to the commands", func() bool {
+		return len(broker.Topics.Subscribers(mqttTopicRoot+"/"+dev.id.String()+"/cmd").Subscriptions) > 0
+	})
+
+	t.Run("reports", func(t *testing.T) {
+		rpt := &kentpb.CliToSrv{RptOneof: &kentpb.CliToSrv_LogRpt{LogRpt: &kentpb.LogReport{Msg: "hello"}}}
+		dev.report(t, rpt)
+
+		got := &kentpb.CliToSrv{}
+		if err := protojson.Unmarshal(expectMQTT(t, msgs, "kent/"+dev.id.String()+"/LogRpt"), got); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(got, rpt) {
+			t.Fatalf("published %v", got)
+		}
+	})
+
+	t.Run("commands", func(t *testing.T) {
+		req := &kentpb.SrvToCli{ReqOneof: &kentpb.SrvToCli_FryerFreezerReq{FryerFreezerReq: &kentpb.FryerFreezerRequest{Idx: 1, Enabled: true}}}
+		p, err := protojson.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := broker.Publish("kent/"+dev.id.String()+"/cmd", p, false, 1); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := dev.request(t); !proto.Equal(got, req) {
+			t.Fatalf("the device got %v", got)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		offline := uuid.New().String()
+		for _, tc := range []struct {
+			dispenserID string
+			payload     string
+			err         string
+		}{
+			{dev.id.String(), `{"notAField": {}}`, "decoding request"},
+			{offline, `{"stateReq": {}}`, errDeviceOffline.Error()},
+			{"not-a-uuid", `{"stateReq": {}}`, "invalid dispenser ID"},
+		} {
+			if err := broker.Publish("kent/"+tc.dispenserID+"/cmd", []byte(tc.payload), false, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			got := string(expectMQTT(t, msgs, "kent/"+tc.dispenserID+"/cmd/error"))
+			if !strings.Contains(got, tc.err) {
+				t.Fatalf("%s: published error %q, want %q", tc.payload, got, tc.err)
+			}
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+wsProtocolJSON - The websocket subprotocol in which kent messages travel as protojson
+in the Msg field of wsMsg instead of base64 protobuf in Binary:
+
+	{"ID": "<dispenser>", "ReqID": "1", "Msg": {"dbgScaleReadReq": {"idx": 2}}}
+
+Clients that don't ask for it get the base64 envelope used by the webUI.
+*/
+const wsProtocolJSON = "kent.protojson.v1"
+
+/*
+reportPayload - A report from a dispenser encoded for websocket clients, each
+encoding is only built when a client using it needs it.
+*/
+type reportPayload struct {
+	msg    wsMsg
+	rpt    *kentpb.CliToSrv
+	binary []byte
+	json   []byte
+}
+
+func newReportPayload(msg wsMsg, rpt *kentpb.CliToSrv) *reportPayload {
+	return &reportPayload{
+		msg: msg,
+		rpt: rpt,
+	}
+}
+
+/*
+forClient - The report in the protocol of the client, nil if it can't be encoded.
+*/
+func (rp *reportPayload) forClient(client *Client) []byte {
+
+	if client.protojson {
+		if rp.json == nil {
+			rp.json = encodeReport(rp.msg, rp.rpt, true)
+		}
+		return rp.json
+	}
+
+	if rp.binary == nil {
+		rp.binary = encodeReport(rp.msg, rp.rpt, false)
+	}
+	return rp.binary
+}
+
+/*
+encodeReport - Put a report in msg as protojson or base64 protobuf and marshal it.
+*/
+func encodeReport(msg wsMsg, rpt *kentpb.CliToSrv, asJSON bool) []byte {
+
+	if asJSON {
+		b, err := protojson.Marshal(rpt)
+		if err != nil {
+			marshalErrors.Add(1)
+			log.Println("Error marshaling", err)
+			return nil
+		}
+		msg.Msg = b
+	} else {
+		b, err := proto.Marshal(rpt)
+		if err != nil {
+			marshalErrors.Add(1)
+			log.Println("Error marshaling", err)
+			return nil
+		}
+		msg.Binary = base64.StdEncoding.EncodeToString(b)
+	}
+
+	p, err := json.Marshal(msg)
+	if err != nil {
+		marshalErrors.Add(1)
+		log.Println("Error marshaling", err)
+		return nil
+	}
+
+	return p
+}
+
+/*
+decodeRequest - The request carried by a websocket message, as protojson in Msg
+or base64 protobuf in Binary.
+*/
+func decodeRequest(msg wsMsg) (*kentpb.SrvToCli, error) {
+
+	req := &kentpb.SrvToCli{}
+
+	if len(msg.Msg) > 0 {
+		if err := protojson.Unmarshal(msg.Msg, req); err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(msg.Binary)
+	if err != nil {
+		return nil, err
+	}
+	if err := proto.Unmarshal(b, req); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
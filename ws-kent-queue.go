@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+
+	"github.com/google/uuid"
+)
+
+var errQueueFull = errors.New("outbound queue full")
+
+var errShuttingDown = errors.New("ws-kent is shutting down")
+
+/*
+outboundMsg - A request from a websocket client waiting to be sent to a dispenser.
+*/
+type outboundMsg struct {
+	client *Client
+	msg    wsMsg
+	req    *kentpb.SrvToCli
+}
+
+/*
+deviceQueue - The requests waiting to be sent to one dispenser.
+*/
+type deviceQueue struct {
+	msgs chan *outboundMsg
+	done chan struct{}
+}
+
+/*
+outboundQueues - A bounded queue per dispenser, each drained by its own goroutine
+so requests to different dispensers go out in parallel. Requests to the same
+dispenser are paced by interval.
+*/
+type outboundQueues struct {
+	mutex    sync.Mutex
+	size     int
+	interval time.Duration
+	send     func(dispenserID uuid.UUID, m *outboundMsg)
+	queues   map[uuid.UUID]*deviceQueue
+	pending  int
+	closed   bool
+	senders  sync.WaitGroup
+}
+
+func newOutboundQueues(size int, interval time.Duration, send func(dispenserID uuid.UUID, m *outboundMsg)) *outboundQueues {
+	return &outboundQueues{
+		size:     size,
+		interval: interval,
+		send:     send,
+		queues:   make(map[uuid.UUID]*deviceQueue),
+	}
+}
+
+/*
+enqueue - Queue a request for a dispenser, starting its sender if needed. Returns
+the queue depth, or errQueueFull when the dispenser already has size requests waiting.
+*/
+func (oq *outboundQueues) enqueue(dispenserID uuid.UUID, m *outboundMsg) (int, error) {
+
+	oq.mutex.Lock()
+	defer oq.mutex.Unlock()
+
+	if oq.closed {
+		return 0, errShuttingDown
+	}
+
+	q, ok := oq.queues[dispenserID]
+	if !ok {
+		q = &deviceQueue{
+			msgs: make(chan *outboundMsg, oq.size),
+			done: make(chan struct{}),
+		}
+		oq.queues[dispenserID] = q
+		oq.senders.Add(1)
+		go oq.run(dispenserID, q)
+	}
+
+	select {
+	case q.msgs <- m:
+		oq.pending++
+		return len(q.msgs), nil
+	default:
+		return len(q.msgs), errQueueFull
+	}
+}
+
+/*
+depth - The number of requests waiting to be sent to a dispenser.
+*/
+func (oq *outboundQueues) depth(dispenserID uuid.UUID) int {
+
+	oq.mutex.Lock()
+	defer oq.mutex.Unlock()
+
+	if q, ok := oq.queues[dispenserID]; ok {
+		return len(q.msgs)
+	}
+	return 0
+}
+
+/*
+depths - The number of requests waiting to be sent to each dispenser.
+*/
+func (oq *outboundQueues) depths() map[uuid.UUID]int {
+
+	oq.mutex.Lock()
+	defer oq.mutex.Unlock()
+
+	depths := make(map[uuid.UUID]int, len(oq.queues))
+	for id, q := range oq.queues {
+		depths[id] = len(q.msgs)
+	}
+	return depths
+}
+
+/*
+stop - Stop the sender of a dispenser and return the requests it never sent.
+*/
+func (oq *outboundQueues) stop(dispenserID uuid.UUID) []*outboundMsg {
+
+	oq.mutex.Lock()
+	defer oq.mutex.Unlock()
+
+	q, ok := oq.queues[dispenserID]
+	if !ok {
+		return nil
+	}
+	delete(oq.queues, dispenserID)
+	close(q.done)
+
+	var unsent []*outboundMsg
+	for {
+		select {
+		case m := <-q.msgs:
+			oq.pending--
+			unsent = append(unsent, m)
+		default:
+			return unsent
+		}
+	}
+}
+
+func (oq *outboundQueues) run(dispenserID uuid.UUID, q *deviceQueue) {
+
+	defer oq.senders.Done()
+
+	for {
+		select {
+		case <-q.done:
+			return
+		case m := <-q.msgs:
+			oq.send(dispenserID, m)
+
+			oq.mutex.Lock()
+			oq.pending--
+			oq.mutex.Unlock()
+		}
+
+		select {
+		case <-q.done:
+			return
+		case <-time.After(oq.interval):
+		}
+	}
+}
+
+/*
+close - Refuse new requests, the queued ones are still sent.
+*/
+func (oq *outboundQueues) close() {
+
+	oq.mutex.Lock()
+	defer oq.mutex.Unlock()
+
+	oq.closed = true
+}
+
+/*
+drain - Wait until every queued request has been sent, or ctx is done.
+*/
+func (oq *outboundQueues) drain(ctx context.Context) error {
+
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		oq.mutex.Lock()
+		pending := oq.pending
+		oq.mutex.Unlock()
+
+		if pending == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d requests not sent: %w", pending, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+stopAll - Stop the sender of every dispenser and return the requests never sent.
+*/
+func (oq *outboundQueues) stopAll() []*outboundMsg {
+
+	oq.mutex.Lock()
+	ids := make([]uuid.UUID, 0, len(oq.queues))
+	for id := range oq.queues {
+		ids = append(ids, id)
+	}
+	oq.mutex.Unlock()
+
+	var unsent []*outboundMsg
+	for _, id := range ids {
+		unsent = append(unsent, oq.stop(id)...)
+	}
+
+	return unsent
+}
+
+/*
+wait - Wait for the senders stopped by stop or stopAll to return.
+*/
+func (oq *outboundQueues) wait() {
+	oq.senders.Wait()
+}
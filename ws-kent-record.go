@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+Recordings hold the kent traffic of one dispenser connection:
+
+	"KENTREC1" | dispenser ID (16 bytes) | frame...
+
+and each frame is
+
+	uvarint length | unix nanoseconds (8 bytes, big endian) | direction (1 byte) | protobuf
+
+where length counts everything after itself. Direction is recordCliToSrv for reports
+from the dispenser and recordSrvToCli for requests sent to it.
+*/
+const recordMagic = "KENTREC1"
+
+const (
+	recordCliToSrv byte = iota + 1
+	recordSrvToCli
+)
+
+// Largest frame accepted when reading a recording.
+const maxRecordFrame = 4 * 1024 * 1024
+
+var errNotRecording = errors.New("not a kent recording")
+
+var errReplaying = errors.New("replaying a recording, requests are not sent")
+
+/*
+recordFrame - One message read back from a recording.
+*/
+type recordFrame struct {
+	time      time.Time
+	direction byte
+	msg       []byte
+}
+
+/*
+sessionRecorder - Writes the traffic of every dispenser to its own recording in dir,
+a new file is started each time a dispenser connects.
+*/
+type sessionRecorder struct {
+	mutex sync.Mutex
+	dir   string
+	files map[uuid.UUID]*os.File
+}
+
+func newSessionRecorder(dir string) (*sessionRecorder, error) {
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return &sessionRecorder{
+		dir:   dir,
+		files: make(map[uuid.UUID]*os.File),
+	}, nil
+}
+
+/*
+record - Append a message to the dispenser's recording. Safe to call on a nil
+recorder when recording is disabled.
+*/
+func (sr *sessionRecorder) record(dispenserID uuid.UUID, direction byte, msg proto.Message) {
+
+	if sr == nil {
+		return
+	}
+
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		log.Println("record: marshalling", err)
+		return
+	}
+
+	frame := make([]byte, 0, binary.MaxVarintLen64+9+len(b))
+	frame = binary.AppendUvarint(frame, uint64(9+len(b)))
+	frame = binary.BigEndian.AppendUint64(frame, uint64(time.Now().UnixNano()))
+	frame = append(frame, direction)
+	frame = append(frame, b...)
+
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	f, ok := sr.files[dispenserID]
+	if !ok {
+		f, err = sr.create(dispenserID)
+		if err != nil {
+			log.Println("record:", err)
+			return
+		}
+		sr.files[dispenserID] = f
+	}
+
+	if _, err := f.Write(frame); err != nil {
+		log.Println("record: writing", f.Name(), err)
+	}
+}
+
+/*
+create - Start a new recording for a dispenser, the caller must hold the mutex.
+Recordings started within the same second get a -2, -3... suffix, an existing
+recording is never appended to.
+*/
+func (sr *sessionRecorder) create(dispenserID uuid.UUID) (*os.File, error) {
+
+	base := fmt.Sprintf("%s-%s", dispenserID, time.Now().Format("20060102-150405"))
+
+	var f *os.File
+	var err error
+	for n := 1; ; n++ {
+		name := base + ".kentrec"
+		if n > 1 {
+			name = fmt.Sprintf("%s-%d.kentrec", base, n)
+		}
+		f, err = os.OpenFile(filepath.Join(sr.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+		if !errors.Is(err, fs.ErrExist) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(recordMagic), dispenserID[:]...)
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+/*
+stop - Close the recording of a dispenser when it disconnects.
+*/
+func (sr *sessionRecorder) stop(dispenserID uuid.UUID) {
+
+	if sr == nil {
+		return
+	}
+
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	if f, ok := sr.files[dispenserID]; ok {
+		f.Close()
+		delete(sr.files, dispenserID)
+	}
+}
+
+func (sr *sessionRecorder) close() {
+
+	if sr == nil {
+		return
+	}
+
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	for id, f := range sr.files {
+		f.Close()
+		delete(sr.files, id)
+	}
+}
+
+/*
+recordReader - Reads the frames of a recording in order.
+*/
+type recordReader struct {
+	r           *bufio.Reader
+	dispenserID uuid.UUID
+}
+
+func newRecordReader(r io.Reader) (*recordReader, error) {
+
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(recordMagic)+16)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(recordMagic)]) != recordMagic {
+		return nil, errNotRecording
+	}
+
+	rr := &recordReader{r: br}
+	copy(rr.dispenserID[:], header[len(recordMagic):])
+
+	return rr, nil
+}
+
+/*
+next - Read the next frame, returns io.EOF at the end of the recording.
+*/
+func (rr *recordReader) next() (recordFrame, error) {
+
+	n, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return recordFrame{}, err
+	}
+	if n < 9 || n > maxRecordFrame {
+		return recordFrame{}, fmt.Errorf("invalid frame length %d", n)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rr.r, b); err != nil {
+		return recordFrame{}, io.ErrUnexpectedEOF
+	}
+
+	return recordFrame{
+		time:      time.Unix(0, int64(binary.BigEndian.Uint64(b[:8]))),
+		direction: b[8],
+		msg:       b[9:],
+	}, nil
+}
+
+/**************************************************************
+ *                           REPLAY                           *
+ **************************************************************/
+
+// Shortest time a replay loop takes, recordings without any delay between their
+// reports are not played in a tight loop.
+const replayMinLoop = time.Second
+
+/*
+checkRecording - Whether path can be opened and is a kent recording.
+*/
+func checkRecording(path string) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := newRecordReader(f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+/*
+replay - Feed the reports of recordings back to the websocket clients as if the
+dispensers were connected, speed 2 plays twice as fast. Waits for a websocket
+client before starting, and starts over when loop is set until every recording
+fails. Stops with the bridge.
+*/
+func (ctx *bridgeCtx) replay(paths []string, speed float64, loop bool) {
+
+	for ctx.cl.count() == 0 {
+		select {
+		case <-ctx.done:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	for {
+		started := time.Now()
+
+		var wg sync.WaitGroup
+		var failedMutex sync.Mutex
+		failed := 0
+		for _, path := range paths {
+			wg.Add(1)
+			go func(path string) {
+				defer wg.Done()
+				if err := ctx.replayFile(path, speed); err != nil {
+					log.Println("replay:", path, err)
+					failedMutex.Lock()
+					failed++
+					failedMutex.Unlock()
+				}
+			}(path)
+		}
+		wg.Wait()
+
+		if !loop {
+			log.Println("replay finished")
+			return
+		}
+		if failed == len(paths) {
+			log.Println("replay stopped, every recording failed")
+			return
+		}
+
+		select {
+		case <-ctx.done:
+			return
+		case <-time.After(replayMinLoop - time.Since(started)):
+		}
+	}
+}
+
+func (ctx *bridgeCtx) replayFile(path string, speed float64) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rr, err := newRecordReader(f)
+	if err != nil {
+		return err
+	}
+
+	// There is no kent server to take the remote address from
+	ctx.broadcastPresence(ctx.devices.online(rr.dispenserID, "replay of "+filepath.Base(path)))
+	defer ctx.onKentDispenserDisconn(rr.dispenserID)
+
+	var last time.Time
+	for {
+		frame, err := rr.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !last.IsZero() && frame.time.After(last) {
+			select {
+			case <-ctx.done:
+				return nil
+			case <-time.After(time.Duration(float64(frame.time.Sub(last)) / speed)):
+			}
+		}
+		last = frame.time
+
+		// Requests are only in the recording for reference
+		if frame.direction != recordCliToSrv {
+			continue
+		}
+
+		msg := &kentpb.CliToSrv{}
+		if err := proto.Unmarshal(frame.msg, msg); err != nil {
+			log.Println("replay: unmarshalling", path, err)
+			continue
+		}
+		ctx.kentMsgHandler(rr.dispenserID, msg)
+	}
+}
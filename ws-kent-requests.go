@@ -0,0 +1,209 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+kentResponses - The report a dispenser answers each request type with. Requests
+not listed here only get a delivery ack.
+*/
+var kentResponses = map[reflect.Type]reflect.Type{
+	reflect.TypeOf(&kentpb.SrvToCli_EepromRReq{}):                  reflect.TypeOf(&kentpb.CliToSrv_EepromRRpt{}),
+	reflect.TypeOf(&kentpb.SrvToCli_DbgScaleReadReq{}):             reflect.TypeOf(&kentpb.CliToSrv_DbgScaleReadResp{}),
+	reflect.TypeOf(&kentpb.SrvToCli_DispenserProcessReq{}):         reflect.TypeOf(&kentpb.CliToSrv_DispenserProcessResp{}),
+	reflect.TypeOf(&kentpb.SrvToCli_FryerProcessReq{}):             reflect.TypeOf(&kentpb.CliToSrv_FryerCookModeResponse{}),
+	reflect.TypeOf(&kentpb.SrvToCli_FryerFreezerReq{}):             reflect.TypeOf(&kentpb.CliToSrv_FryerFreezerResp{}),
+	reflect.TypeOf(&kentpb.SrvToCli_FryerFreezerDrawerUnlockReq{}): reflect.TypeOf(&kentpb.CliToSrv_FryerUnlockFreezerResponse{}),
+	reflect.TypeOf(&kentpb.SrvToCli_FryerHotHoldReq{}):             reflect.TypeOf(&kentpb.CliToSrv_FryerHotHoldResponse{}),
+}
+
+/*
+oneofType - The type of the oneof wrapper set on a kent message, e.g.
+*kentpb.CliToSrv_EepromRRpt, or nil when none is set.
+*/
+func oneofType(msg proto.Message) reflect.Type {
+
+	v := reflect.ValueOf(msg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Interface && v.Type().Field(i).IsExported() && !field.IsNil() {
+			return field.Elem().Type()
+		}
+	}
+
+	return nil
+}
+
+/*
+reqName - The name of the request set on a SrvToCli message, e.g. EepromRReq.
+*/
+func reqName(req *kentpb.SrvToCli) string {
+	if req.GetReqOneof() == nil {
+		return ""
+	}
+	return strings.TrimPrefix(reflect.TypeOf(req.GetReqOneof()).Elem().Name(), "SrvToCli_")
+}
+
+/*
+rptName - The name of a CliToSrv oneof wrapper, e.g. EepromRRpt for a *kentpb.CliToSrv_EepromRRpt.
+*/
+func rptName(wrapper interface{}) string {
+	return strings.TrimPrefix(reflect.TypeOf(wrapper).Elem().Name(), "CliToSrv_")
+}
+
+/*
+reportName - The name of the report set on a CliToSrv message, e.g. EepromRRpt.
+*/
+func reportName(rpt *kentpb.CliToSrv) string {
+	t := oneofType(rpt)
+	if t == nil {
+		return ""
+	}
+	return strings.TrimPrefix(t.Elem().Name(), "CliToSrv_")
+}
+
+/*
+pendingRequest - A request delivered to a dispenser that is waiting for its report.
+*/
+type pendingRequest struct {
+	client *Client
+	reqID  string
+	rpt    reflect.Type
+	timer  *time.Timer
+}
+
+/*
+pendingRequests - The requests waiting for a report, per dispenser in the order
+they were sent.
+*/
+type pendingRequests struct {
+	mutex   sync.Mutex
+	timeout time.Duration
+	pending map[uuid.UUID][]*pendingRequest
+}
+
+func newPendingRequests(timeout time.Duration) *pendingRequests {
+	return &pendingRequests{
+		timeout: timeout,
+		pending: make(map[uuid.UUID][]*pendingRequest),
+	}
+}
+
+/*
+add - Wait for the report answering req. onTimeout is called if the dispenser
+does not answer in time. Returns nil if req has no matching report.
+*/
+func (pr *pendingRequests) add(dispenserID uuid.UUID, client *Client, reqID string, req *kentpb.SrvToCli, onTimeout func(p *pendingRequest)) *pendingRequest {
+
+	rpt, ok := kentResponses[reflect.TypeOf(req.GetReqOneof())]
+	if !ok {
+		return nil
+	}
+
+	p := &pendingRequest{
+		client: client,
+		reqID:  reqID,
+		rpt:    rpt,
+	}
+
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	p.timer = time.AfterFunc(pr.timeout, func() {
+		if pr.remove(dispenserID, p) {
+			onTimeout(p)
+		}
+	})
+	pr.pending[dispenserID] = append(pr.pending[dispenserID], p)
+
+	return p
+}
+
+/*
+match - Take the oldest request from the dispenser waiting for this report.
+*/
+func (pr *pendingRequests) match(dispenserID uuid.UUID, rpt *kentpb.CliToSrv) *pendingRequest {
+
+	t := oneofType(rpt)
+
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	for i, p := range pr.pending[dispenserID] {
+		if p.rpt == t {
+			p.timer.Stop()
+			return pr.take(dispenserID, i)
+		}
+	}
+
+	return nil
+}
+
+/*
+remove - Forget a pending request, returns false if it was already answered.
+*/
+func (pr *pendingRequests) remove(dispenserID uuid.UUID, req *pendingRequest) bool {
+
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	for i, p := range pr.pending[dispenserID] {
+		if p == req {
+			p.timer.Stop()
+			pr.take(dispenserID, i)
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+stopAll - Forget every pending request, their timeouts are never reported.
+*/
+func (pr *pendingRequests) stopAll() {
+
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	for dispenserID, list := range pr.pending {
+		for _, p := range list {
+			p.timer.Stop()
+		}
+		delete(pr.pending, dispenserID)
+	}
+}
+
+/*
+take - Remove the i'th pending request of a dispenser, the caller must hold the mutex.
+*/
+func (pr *pendingRequests) take(dispenserID uuid.UUID, i int) *pendingRequest {
+
+	list := pr.pending[dispenserID]
+	p := list[i]
+
+	list = append(list[:i], list[i+1:]...)
+	if len(list) == 0 {
+		delete(pr.pending, dispenserID)
+	} else {
+		pr.pending[dispenserID] = list
+	}
+
+	return p
+}
+
+/*
+rptName - The name of the report the request is waiting for, e.g. EepromRRpt.
+*/
+func (p *pendingRequest) rptName() string {
+	return strings.TrimPrefix(p.rpt.Elem().Name(), "CliToSrv_")
+}
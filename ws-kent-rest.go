@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+/*
+REST API for scripts and jigs, requests go through the same queues, audit log and
+report correlation as the websocket ones:
+
+	GET  /devices                  The connected dispensers
+	POST /devices/{id}/commands    Send the protojson SrvToCli in the body
+	GET  /devices/{id}/eeprom      Read the EEPROM
+	GET  /devices/{id}/reports     The stored reports, see restReports
+	GET  /devices/{id}/state       The last state, snapshot and EEPROM reports
+	POST /devices/{id}/reboot      Reboot the dispenser
+
+Commands answer with the final wsMsg of the request, the report in Msg when the
+request has one. The POST endpoints need an auth file, see checkRESTPost.
+*/
+
+// Largest request body accepted by the REST API.
+const maxRESTBody = 1024 * 1024
+
+/*
+restDevices - GET /devices.
+*/
+func (ctx *bridgeCtx) restDevices(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := ctx.restOperator(w, r); !ok {
+		return
+	}
+
+	restJSON(w, http.StatusOK, ctx.devices.snapshot())
+}
+
+/*
+restDevice - The /devices/{id}/... endpoints.
+*/
+func (ctx *bridgeCtx) restDevice(w http.ResponseWriter, r *http.Request) {
+
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/devices/"), "/")
+	dispenserID, err := uuid.Parse(id)
+	if err != nil {
+		http.Error(w, "invalid dispenser ID", http.StatusBadRequest)
+		return
+	}
+
+	op, ok := ctx.restOperator(w, r)
+	if !ok {
+		return
+	}
+
+	if action == "reports" || action == "state" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if action == "reports" {
+			ctx.restReports(w, r, dispenserID)
+		} else {
+			ctx.restState(w, r, dispenserID)
+		}
+		return
+	}
+
+	if r.Method == http.MethodPost && !ctx.checkRESTPost(w, r) {
+		return
+	}
+
+	var req *kentpb.SrvToCli
+	switch {
+	case action == "commands" && r.Method == http.MethodPost:
+		b, err := io.ReadAll(io.LimitReader(r.Body, maxRESTBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req = &kentpb.SrvToCli{}
+		if err := protojson.Unmarshal(b, req); err != nil {
+			http.Error(w, "decoding request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	case action == "eeprom" && r.Method == http.MethodGet:
+		req = &kentpb.SrvToCli{ReqOneof: &kentpb.SrvToCli_EepromRReq{}}
+	case action == "reboot" && r.Method == http.MethodPost:
+		req = &kentpb.SrvToCli{ReqOneof: &kentpb.SrvToCli_RebootReq{}}
+	case action == "commands" || action == "eeprom" || action == "reboot":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx.restCommand(w, r, op, dispenserID, req)
+}
+
+/*
+restCommand - Queue a request for a dispenser and answer once it is delivered, or
+once its report arrives if it has one.
+*/
+func (ctx *bridgeCtx) restCommand(w http.ResponseWriter, r *http.Request, op operator, dispenserID uuid.UUID, req *kentpb.SrvToCli) {
+
+	client := newLocalClient(op, r.RemoteAddr)
+	defer client.close()
+
+	msg := wsMsg{
+		ID:    dispenserID,
+		ReqID: uuid.New().String(),
+	}
+
+	err := ctx.admit(client, msg, req)
+	ctx.audit.record(client, msg, req, err)
+	if err != nil {
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, errForbidden) {
+			status = http.StatusForbidden
+		} else if errors.Is(err, errDeviceOffline) {
+			status = http.StatusNotFound
+		}
+		restJSON(w, status, wsMsg{Type: wsMsgAck, ID: dispenserID, ReqID: msg.ReqID, Error: err.Error()})
+		return
+	}
+
+	reply, ok := client.awaitReply(r.Context().Done(), msg.ReqID)
+	if !ok {
+		return
+	}
+
+	switch {
+	case reply.Type == wsMsgAck && reply.Error != "":
+		restJSON(w, http.StatusBadGateway, reply)
+	case reply.Type == wsMsgTimeout:
+		restJSON(w, http.StatusGatewayTimeout, reply)
+	default:
+		restJSON(w, http.StatusOK, reply)
+	}
+}
+
+/*
+restOperator - The operator making a REST request, from its bearer token when
+ws-kent runs with an auth file.
+*/
+func (ctx *bridgeCtx) restOperator(w http.ResponseWriter, r *http.Request) (operator, bool) {
+
+	if ctx.auth == nil {
+		return anonymousOperator, true
+	}
+
+	op, err := ctx.auth.authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return operator{}, false
+	}
+
+	return op, true
+}
+
+/*
+checkRESTPost - Only scripts may change dispensers: a POST must carry its token in
+the Authorization header and a JSON body, and come from an allowed origin when
+sent by a browser. Pages can then neither post a form nor reuse a token from the
+URL. Without an auth file there is no token and every POST is refused.
+*/
+func (ctx *bridgeCtx) checkRESTPost(w http.ResponseWriter, r *http.Request) bool {
+
+	if !ctx.upgrader.CheckOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return false
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		http.Error(w, "the body must be application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	if ctx.auth == nil {
+		http.Error(w, "commands need ws-kent to run with -authFile", http.StatusForbidden)
+		return false
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		http.Error(w, "commands need a token in the Authorization header", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+func restJSON(w http.ResponseWriter, status int, v interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("REST:", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRESTPostChecks(t *testing.T) {
+
+	authFile := filepath.Join(t.TempDir(), "auth.json")
+	err := os.WriteFile(authFile, []byte(`{"tokens": [{"name": "jig", "token": "secret", "role": "factory"}]}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := startBridge(t, bridgeConfig{AuthFile: authFile})
+	dev := connectDevice(t, ctx)
+	reboot := "http://" + ctx.addr().String() + "/devices/" + dev.id.String() + "/reboot"
+	commands := "http://" + ctx.addr().String() + "/devices/" + dev.id.String() + "/commands"
+
+	for _, tc := range []struct {
+		name   string
+		url    string
+		header map[string]string
+		status int
+	}{
+		{"no token", reboot, map[string]string{"Content-Type": "application/json"}, http.StatusUnauthorized},
+		{"token in the URL", reboot + "?token=secret", map[string]string{"Content-Type": "application/json"}, http.StatusUnauthorized},
+		{"form", reboot, map[string]string{"Authorization": "Bearer secret", "Content-Type": "application/x-www-form-urlencoded"}, http.StatusUnsupportedMediaType},
+		{"foreign origin", reboot, map[string]string{"Authorization": "Bearer secret", "Content-Type": "application/json", "Origin": "http://evil.example"}, http.StatusForbidden},
+		{"reboot", reboot, map[string]string{"Authorization": "Bearer secret", "Content-Type": "application/json"}, http.StatusOK},
+		{"command", commands, map[string]string{"Authorization": "Bearer secret", "Content-Type": "application/json; charset=utf-8"}, http.StatusOK},
+	} {
+		req, err := http.NewRequest(http.MethodPost, tc.url, strings.NewReader(`{"stateReq": {}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.name, resp.StatusCode, tc.status)
+		}
+	}
+
+	// Only the accepted posts reached the dispenser
+	if got := dev.request(t); reqName(got) != "RebootReq" {
+		t.Fatalf("the device got %s first", reqName(got))
+	}
+	if got := dev.request(t); reqName(got) != "StateReq" {
+		t.Fatalf("the device got %s second", reqName(got))
+	}
+}
+
+func TestRESTPostNeedsAuthFile(t *testing.T) {
+
+	ctx := startBridge(t, bridgeConfig{})
+	dev := connectDevice(t, ctx)
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+ctx.addr().String()+"/devices/"+dev.id.String()+"/reboot", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer anything")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status %d without an auth file, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iwdfryer/kent"
+	"github.com/iwdfryer/kent/proto/kentpb"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	simDispenser = "dispenser"
+	simFryer     = "fryer"
+)
+
+// simFryerID is the dispenser ID the webUI has always used for the simulated fryer.
+var simFryerID = uuid.MustParse("ed668654-8994-47a3-9c55-7cb9509e4daf")
+
+// The number of each part of the simulated devices, matching the webUI.
+const (
+	NB_OF_SIM_SCALES           = 5
+	NB_OF_SIM_STEPPERS         = 12
+	NB_OF_SIM_DC_MOTORS        = 6
+	NB_OF_SIM_PID_SETTINGS     = 4
+	NB_OF_SIM_MASS_SETTINGS    = 4
+	NB_OF_SIM_TEMP_CONTROLLERS = 2
+	NB_OF_SIM_TRANSPORTS       = 11
+)
+
+// The states reported by the simulated dispensers.
+const (
+	simDispenserIdle       = 0
+	simDispenserDispensing = 1
+)
+
+const (
+	// Interval between the PID debug reports of a simulated dispense.
+	simPidInterval = 100 * time.Millisecond
+
+	// How long a simulated device is offline when rebooted.
+	simRebootTime = 2 * time.Second
+
+	// Requests that may wait for an attached dispenser to handle them.
+	simQueueSize = 64
+)
+
+var errSimBusy = errors.New("simulated dispenser busy")
+
+/*
+simServer - A kent server with dispensers attached in process, the simulated ones
+and those of the tests. Requests to an attached dispenser are handed to it, every
+other goes to the kent server.
+*/
+type simServer struct {
+	kent.Server
+
+	mutex    sync.Mutex
+	attached map[uuid.UUID]*simConn
+	onOnline func(uuid.UUID)
+	onDisc   func(uuid.UUID)
+	onReport func(uuid.UUID, *kentpb.CliToSrv)
+}
+
+/*
+simConn - The connection of an attached dispenser, dropped is closed once it is
+detached.
+*/
+type simConn struct {
+	requests chan *kentpb.SrvToCli
+	dropped  chan struct{}
+}
+
+/*
+simAddr - The remote address of the attached dispensers.
+*/
+type simAddr struct{}
+
+func (simAddr) Network() string { return "sim" }
+func (simAddr) String() string  { return "simulated" }
+
+func newSimServer(srv kent.Server) *simServer {
+	return &simServer{
+		Server:   srv,
+		attached: make(map[uuid.UUID]*simConn),
+	}
+}
+
+/*
+subscribe - The callbacks of the attached dispensers coming online, going offline
+and reporting, the ones registered on the kent server only get its own dispensers.
+*/
+func (ss *simServer) subscribe(online func(uuid.UUID), disc func(uuid.UUID), report func(uuid.UUID, *kentpb.CliToSrv)) {
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	ss.onOnline = online
+	ss.onDisc = disc
+	ss.onReport = report
+}
+
+/*
+attach - Bring a dispenser online, the requests sent to it arrive on its connection.
+*/
+func (ss *simServer) attach(dispenserID uuid.UUID) *simConn {
+
+	conn := &simConn{
+		requests: make(chan *kentpb.SrvToCli, simQueueSize),
+		dropped:  make(chan struct{}),
+	}
+
+	ss.mutex.Lock()
+	ss.attached[dispenserID] = conn
+	online := ss.onOnline
+	ss.mutex.Unlock()
+
+	if online != nil {
+		online(dispenserID)
+	}
+	return conn
+}
+
+/*
+detach - Take a dispenser offline. Safe to call for a dispenser already detached.
+*/
+func (ss *simServer) detach(dispenserID uuid.UUID) {
+
+	ss.mutex.Lock()
+	conn, ok := ss.attached[dispenserID]
+	delete(ss.attached, dispenserID)
+	disc := ss.onDisc
+	ss.mutex.Unlock()
+
+	if !ok {
+		return
+	}
+	close(conn.dropped)
+	if disc != nil {
+		disc(dispenserID)
+	}
+}
+
+/*
+report - Deliver a report from an attached dispenser like the kent server would,
+dropped once it is detached.
+*/
+func (ss *simServer) report(dispenserID uuid.UUID, rpt *kentpb.CliToSrv) {
+
+	ss.mutex.Lock()
+	_, ok := ss.attached[dispenserID]
+	report := ss.onReport
+	ss.mutex.Unlock()
+
+	if ok && report != nil {
+		report(dispenserID, rpt)
+	}
+}
+
+func (ss *simServer) SendData(dispenserID uuid.UUID, msg *kentpb.SrvToCli) error {
+
+	ss.mutex.Lock()
+	conn, ok := ss.attached[dispenserID]
+	ss.mutex.Unlock()
+
+	if !ok {
+		return ss.Server.SendData(dispenserID, msg)
+	}
+
+	select {
+	case conn.requests <- msg:
+		return nil
+	default:
+		return errSimBusy
+	}
+}
+
+/*
+RemoteAddr - Attached dispensers have no address, the others are looked up on the
+kent server when it can tell.
+*/
+func (ss *simServer) RemoteAddr(dispenserID uuid.UUID) net.Addr {
+
+	ss.mutex.Lock()
+	_, ok := ss.attached[dispenserID]
+	ss.mutex.Unlock()
+
+	if ok {
+		return simAddr{}
+	}
+	if srv, ok := ss.Server.(kentAddrServer); ok {
+		return srv.RemoteAddr(dispenserID)
+	}
+	return nil
+}
+
+/*
+Stop - Detach every dispenser, and stop the kent server when it can be.
+*/
+func (ss *simServer) Stop() error {
+
+	ss.mutex.Lock()
+	ids := make([]uuid.UUID, 0, len(ss.attached))
+	for id := range ss.attached {
+		ids = append(ids, id)
+	}
+	ss.mutex.Unlock()
+
+	for _, id := range ids {
+		ss.detach(id)
+	}
+	if srv, ok := ss.Server.(kentStopServer); ok {
+		return srv.Stop()
+	}
+	return nil
+}
+
+/**************************************************************
+ *                         SIMULATOR                          *
+ **************************************************************/
+
+/*
+simulator - Simulated dispensers and fryers attached to the kent server, reacting
+to requests like the firmware would.
+*/
+type simulator struct {
+	devices  []*simDevice
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+/*
+simDevice - The state of one simulated dispenser or fryer.
+*/
+type simDevice struct {
+	mutex      sync.Mutex
+	id         uuid.UUID
+	kind       string
+	eeprom     *kentpb.EepromReadReport
+	tare       map[uint32]int32
+	state      kentpb.FryerOperatingState
+	dispensing bool
+	freezer    map[uint32]bool
+	hotHold    map[uint32]bool
+	process    int
+	srv        *simServer
+	reboot     chan struct{}
+	sim        *simulator
+}
+
+/*
+newSimulator - Simulated devices from a comma separated list of kind[:eeprom.json],
+kind being dispenser or fryer. The EEPROM file is the protojson of an EepromRRpt and
+replaces the default EEPROM contents, including the device type of its factory data.
+*/
+func newSimulator(spec string) (*simulator, error) {
+
+	sim := &simulator{
+		done: make(chan struct{}),
+	}
+
+	count := make(map[string]int)
+	for _, item := range strings.Split(spec, ",") {
+		kind, eepromFile, _ := strings.Cut(strings.TrimSpace(item), ":")
+		if kind != simDispenser && kind != simFryer {
+			return nil, fmt.Errorf("unknown simulated device %q, expected %s or %s", kind, simDispenser, simFryer)
+		}
+
+		id := uuid.NewSHA1(uuid.NameSpaceOID, []byte(fmt.Sprintf("ws-kent-sim-%s-%d", kind, count[kind])))
+		if kind == simFryer && count[kind] == 0 {
+			id = simFryerID
+		}
+		count[kind]++
+
+		dev := &simDevice{
+			id:      id,
+			kind:    kind,
+			eeprom:  simDefaultEeprom(kind, id),
+			tare:    make(map[uint32]int32),
+			freezer: make(map[uint32]bool),
+			hotHold: make(map[uint32]bool),
+			reboot:  make(chan struct{}, 1),
+			sim:     sim,
+		}
+
+		if eepromFile != "" {
+			b, err := os.ReadFile(eepromFile)
+			if err != nil {
+				return nil, err
+			}
+			dev.eeprom = &kentpb.EepromReadReport{}
+			if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(b, dev.eeprom); err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", eepromFile, err)
+			}
+		}
+
+		sim.devices = append(sim.devices, dev)
+	}
+
+	return sim, nil
+}
+
+/*
+start - Attach every simulated device to srv.
+*/
+func (sim *simulator) start(srv *simServer) {
+
+	for _, dev := range sim.devices {
+		log.Println("simulating", dev.kind, dev.id)
+		sim.wg.Add(1)
+		go func(dev *simDevice) {
+			defer sim.wg.Done()
+			dev.run(srv)
+		}(dev)
+	}
+}
+
+/*
+stop - Detach every simulated device and wait for their dispenses to end. Safe to
+call on a nil simulator.
+*/
+func (sim *simulator) stop() {
+
+	if sim == nil {
+		return
+	}
+
+	sim.stopOnce.Do(func() {
+		close(sim.done)
+	})
+	sim.wg.Wait()
+}
+
+/*
+goRun - Run f in its own goroutine until it returns, the simulator waits for it
+when stopped.
+*/
+func (sim *simulator) goRun(f func()) {
+
+	sim.wg.Add(1)
+	go func() {
+		defer sim.wg.Done()
+		f()
+	}()
+}
+
+/**************************************************************
+ *                      SIMULATED DEVICE                      *
+ **************************************************************/
+
+/*
+run - Keep the device attached to srv, handling its requests, until the simulator
+stops or the server drops it. A reboot takes it offline for a while.
+*/
+func (dev *simDevice) run(srv *simServer) {
+
+	for {
+		conn := srv.attach(dev.id)
+		dev.setServer(srv)
+		rebooted := dev.serve(conn)
+		dev.setServer(nil)
+		srv.detach(dev.id)
+
+		if !rebooted {
+			return
+		}
+		select {
+		case <-dev.sim.done:
+			return
+		case <-time.After(simRebootTime):
+		}
+	}
+}
+
+/*
+serve - Handle the requests of a connection until it is dropped, the simulator
+stops or the device reboots, telling whether it rebooted.
+*/
+func (dev *simDevice) serve(conn *simConn) bool {
+
+	for {
+		select {
+		case <-dev.sim.done:
+			return false
+		case <-conn.dropped:
+			log.Println("simulated", dev.kind, dev.id, "dropped by the kent server")
+			return false
+		case <-dev.reboot:
+			return true
+		case req := <-conn.requests:
+			dev.handle(req)
+		}
+	}
+}
+
+/*
+setServer - The server reports are sent to, nil while offline. Going offline
+aborts a running dispense.
+*/
+func (dev *simDevice) setServer(srv *simServer) {
+
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+
+	dev.srv = srv
+	if srv == nil {
+		dev.process++
+		dev.dispensing = false
+	}
+}
+
+/*
+send - Send a report to the kent server, dropped while the device is offline.
+*/
+func (dev *simDevice) send(rpt *kentpb.CliToSrv) {
+
+	dev.mutex.Lock()
+	srv := dev.srv
+	dev.mutex.Unlock()
+
+	if srv != nil {
+		srv.report(dev.id, rpt)
+	}
+}
+
+/*
+handle - React to a request from the kent server the way the firmware would.
+Long running requests report from their own goroutine.
+*/
+func (dev *simDevice) handle(req *kentpb.SrvToCli) {
+
+	var rpts []*kentpb.CliToSrv
+
+	dev.mutex.Lock()
+
+	switch r := req.GetReqOneof().(type) {
+	case *kentpb.SrvToCli_RebootReq:
+		select {
+		case dev.reboot <- struct{}{}:
+		default:
+		}
+
+	case *kentpb.SrvToCli_EepromRReq:
+		rpts = append(rpts, &kentpb.CliToSrv{
+			RptOneof: &kentpb.CliToSrv_EepromRRpt{EepromRRpt: proto.Clone(dev.eeprom).(*kentpb.EepromReadReport)},
+		})
+
+	case *kentpb.SrvToCli_EepromFactoryReq:
+		dev.eeprom.FactoryRpt = r.EepromFactoryReq
+	case *kentpb.SrvToCli_EepromScaleReq:
+		dev.eeprom.ScaleRpt = simSetEntry(dev.eeprom.ScaleRpt, r.EepromScaleReq)
+	case *kentpb.SrvToCli_EepromStepperReq:
+		dev.eeprom.StepperRpt = simSetEntry(dev.eeprom.StepperRpt, r.EepromStepperReq)
+	case *kentpb.SrvToCli_EepromDcmotorReq:
+		dev.eeprom.DcmotRpt = simSetEntry(dev.eeprom.DcmotRpt, r.EepromDcmotorReq)
+	case *kentpb.SrvToCli_DispenserEepromMassReq:
+		dev.eeprom.MassRpt = simSetEntry(dev.eeprom.MassRpt, r.DispenserEepromMassReq)
+	case *kentpb.SrvToCli_EepromPidReq:
+		dev.eeprom.PidRpt = simSetEntry(dev.eeprom.PidRpt, r.EepromPidReq)
+	case *kentpb.SrvToCli_EepromTemperatureReq:
+		dev.eeprom.TemperatureRpt = simSetEntry(dev.eeprom.TemperatureRpt, r.EepromTemperatureReq)
+	case *kentpb.SrvToCli_EepromIngredientReq:
+		dev.eeprom.IngredientRpt = simSetEntry(dev.eeprom.IngredientRpt, r.EepromIngredientReq)
+	case *kentpb.SrvToCli_FryerEepromPositionsReq:
+		dev.eeprom.TransportRpt = simSetEntry(dev.eeprom.TransportRpt, r.FryerEepromPositionsReq)
+
+	case *kentpb.SrvToCli_DbgScaleReadReq:
+		rpts = append(rpts, dev.scaleReading(r.DbgScaleReadReq.GetIdx()))
+	case *kentpb.SrvToCli_DispenserDbgHopperReadReq:
+		rpts = append(rpts, dev.scaleReading(r.DispenserDbgHopperReadReq.GetIdx()))
+	case *kentpb.SrvToCli_DbgScaleTareReq:
+		idx := r.DbgScaleTareReq.GetIdx()
+		dev.tare[idx] = simScaleLoad(idx)
+
+	case *kentpb.SrvToCli_DispenserProcessReq:
+		dev.process++
+		dev.dispensing = true
+		process, req := dev.process, r.DispenserProcessReq
+		dev.sim.goRun(func() {
+			dev.dispense(process, req)
+		})
+		rpts = append(rpts, dev.stateReport())
+
+	case *kentpb.SrvToCli_FryerProcessReq:
+		rpts = append(rpts, &kentpb.CliToSrv{
+			RptOneof: &kentpb.CliToSrv_FryerCookModeResponse{FryerCookModeResponse: &kentpb.GenericResponse{Idx: r.FryerProcessReq.GetFryPositionIdx()}},
+		})
+	case *kentpb.SrvToCli_FryerFreezerReq:
+		idx := r.FryerFreezerReq.GetIdx()
+		dev.freezer[idx] = r.FryerFreezerReq.GetEnabled()
+		rpts = append(rpts, &kentpb.CliToSrv{
+			RptOneof: &kentpb.CliToSrv_FryerFreezerResp{FryerFreezerResp: &kentpb.GenericResponse{Idx: idx}},
+		}, dev.stateReport())
+	case *kentpb.SrvToCli_FryerFreezerDrawerUnlockReq:
+		rpts = append(rpts, &kentpb.CliToSrv{
+			RptOneof: &kentpb.CliToSrv_FryerUnlockFreezerResponse{FryerUnlockFreezerResponse: &kentpb.GenericResponse{Idx: r.FryerFreezerDrawerUnlockReq.GetIdx()}},
+		})
+	case *kentpb.SrvToCli_FryerHotHoldReq:
+		idx := r.FryerHotHoldReq.GetIdx()
+		dev.hotHold[idx] = r.FryerHotHoldReq.GetEnabled()
+		rpts = append(rpts, &kentpb.CliToSrv{
+			RptOneof: &kentpb.CliToSrv_FryerHotHoldResponse{FryerHotHoldResponse: &kentpb.GenericResponse{Idx: idx}},
+		}, dev.stateReport())
+	case *kentpb.SrvToCli_FryerSetOperatingStateReq:
+		dev.state = r.FryerSetOperatingStateReq.GetState()
+		rpts = append(rpts, dev.stateReport())
+	case *kentpb.SrvToCli_StateReq:
+		rpts = append(rpts, dev.stateReport())
+	}
+
+	dev.mutex.Unlock()
+
+	for _, rpt := range rpts {
+		dev.send(rpt)
+	}
+}
+
+/*
+stateReport - The fryer or dispenser state report. The caller must hold the mutex.
+*/
+func (dev *simDevice) stateReport() *kentpb.CliToSrv {
+
+	if dev.kind == simFryer {
+		return &kentpb.CliToSrv{
+			RptOneof: &kentpb.CliToSrv_FryerStateRpt{FryerStateRpt: &kentpb.FryerStateReport{State: dev.state}},
+		}
+	}
+	rpt := &kentpb.DispenserStateReport{State: simDispenserIdle}
+	if dev.dispensing {
+		rpt.State = simDispenserDispensing
+	}
+	return &kentpb.CliToSrv{
+		RptOneof: &kentpb.CliToSrv_DispenserStateRpt{DispenserStateRpt: rpt},
+	}
+}
+
+/*
+simSetEntry - Replace the entry of an EEPROM list with the same idx as e, or add e.
+*/
+func simSetEntry[T interface{ GetIdx() uint32 }](list []T, e T) []T {
+
+	for i := range list {
+		if list[i].GetIdx() == e.GetIdx() {
+			list[i] = e
+			return list
+		}
+	}
+	return append(list, e)
+}
+
+/*
+scaleReading - A noisy reading of a scale, in mg, minus its tare. The caller must
+hold the mutex.
+*/
+func (dev *simDevice) scaleReading(idx uint32) *kentpb.CliToSrv {
+
+	mg := simScaleLoad(idx) - dev.tare[idx] + int32(rand.NormFloat64()*150)
+
+	return &kentpb.CliToSrv{
+		RptOneof: &kentpb.CliToSrv_DbgScaleReadResp{DbgScaleReadResp: &kentpb.DbgScaleReadResponse{Idx: idx, WeightMg: mg}},
+	}
+}
+
+/*
+simScaleLoad - The mass sitting on a scale, a hopper of product on top of the tray.
+*/
+func simScaleLoad(idx uint32) int32 {
+	return 350000 + int32(idx)*25000
+}
+
+/*
+dispense - Run a dispense, sending PID debug reports as the dispensed mass converges
+on the requested mass, then the process response and the dispenser back to idle.
+A newer process, a reboot or the simulator stopping aborts it.
+*/
+func (dev *simDevice) dispense(process int, req *kentpb.DispenserProcessRequest) {
+
+	duration := time.Duration(req.GetSimulationTimeMs()) * time.Millisecond
+	if duration == 0 {
+		duration = 3 * time.Second
+	}
+
+	sp := int32(req.GetMassMg()) + req.GetMassCorrectionMg()
+	var pv, integ, prevErr int32
+	steps := int(duration / simPidInterval)
+
+	ticker := time.NewTicker(simPidInterval)
+	defer ticker.Stop()
+
+	for counter := 0; counter < steps; counter++ {
+		select {
+		case <-dev.sim.done:
+			return
+		case <-ticker.C:
+		}
+
+		dev.mutex.Lock()
+		aborted := dev.process != process
+		dev.mutex.Unlock()
+		if aborted {
+			return
+		}
+
+		// Exponential approach to the set point with some product noise
+		pv += int32(float64(sp-pv)*0.25 + rand.NormFloat64()*float64(sp)*0.002)
+		errMg := sp - pv
+		integ += errMg
+		deriv := errMg - prevErr
+		prevErr = errMg
+
+		p, i, d := errMg/10, integ/100, deriv/20
+		dev.send(&kentpb.CliToSrv{
+			RptOneof: &kentpb.CliToSrv_DispenserPidDbgRpt{DispenserPidDbgRpt: &kentpb.DispenserPidDbgReport{
+				Run:     1,
+				Counter: uint32(counter),
+				Time:    uint32(counter) * uint32(simPidInterval/time.Millisecond),
+				Sp:      sp,
+				Pv:      pv,
+				Cv:      int32(math.Max(0, float64(p+i+d))),
+				FError:  errMg,
+				FInteg:  integ,
+				FDeriv:  deriv,
+				P:       p,
+				I:       i,
+				D:       d,
+			}},
+		})
+	}
+
+	dev.mutex.Lock()
+	if dev.process != process {
+		dev.mutex.Unlock()
+		return
+	}
+	dev.dispensing = false
+	state := dev.stateReport()
+	dev.mutex.Unlock()
+
+	dev.send(&kentpb.CliToSrv{
+		RptOneof: &kentpb.CliToSrv_DispenserProcessResp{DispenserProcessResp: &kentpb.GenericResponse{Idx: req.GetIdx()}},
+	})
+	dev.send(state)
+}
+
+/**************************************************************
+ *                       SIMULATED DATA                       *
+ **************************************************************/
+
+/*
+simDefaultEeprom - Plausible EEPROM contents for a simulated device.
+*/
+func simDefaultEeprom(kind string, id uuid.UUID) *kentpb.EepromReadReport {
+
+	deviceType := kentpb.EepromFactoryData_DT_DEFAULT
+	if kind == simFryer {
+		deviceType = kentpb.EepromFactoryData_DT_FRYER_PORTIONING
+	}
+
+	eeprom := &kentpb.EepromReadReport{
+		FactoryRpt: &kentpb.EepromFactoryData{
+			Mac:        []byte{0x02, 0x00, 0x00, id[13], id[14], id[15]},
+			Id:         id.String(),
+			DeviceType: deviceType,
+			HwRev:      1,
+		},
+		IngredientRpt: []*kentpb.EepromIngredientData{{Idx: 0, Ingredient: "fries"}},
+	}
+	for i := uint32(0); i < NB_OF_SIM_SCALES; i++ {
+		eeprom.ScaleRpt = append(eeprom.ScaleRpt, &kentpb.EepromScaleData{Idx: i, FullCalibSamples: 20, TareSamples: 10, ReadingSamples: 5, CalibWeightG: 500, ZeroCalibSamples: 10, TrayWeightG: 120})
+	}
+	for i := uint32(0); i < NB_OF_SIM_STEPPERS; i++ {
+		eeprom.StepperRpt = append(eeprom.StepperRpt, &kentpb.EepromStepperData{Idx: i, Direction: 0, FSpeedMaxRps: 2000, FAccelRpss: 8000, CurrentMax: 1500, CurrentMin: 300, RetreatSpeedPct: 50, RetreatAngle: -90, HoldCurrent: 200, FDecelRpss: 8000, FHomeSpeedRps: 500, FHomeAccelRpss: 2000})
+	}
+	for i := uint32(0); i < NB_OF_SIM_DC_MOTORS; i++ {
+		eeprom.DcmotRpt = append(eeprom.DcmotRpt, &kentpb.EepromDcMotorData{Idx: i, Direction: 0, SpeedPct: 80, RetreatSpeedPct: 40, RetreatTimeMs: 200})
+	}
+	for i := uint32(0); i < NB_OF_SIM_PID_SETTINGS; i++ {
+		eeprom.PidRpt = append(eeprom.PidRpt, &kentpb.EepromPidData{Idx: i, FKp: 1200, FKi: 80, FKd: 15, SaturMax: 10000, SaturMin: 0, DeltaT: 100, Offset: 0, SamplingTimeMs: 100})
+	}
+	for i := uint32(0); i < NB_OF_SIM_MASS_SETTINGS; i++ {
+		eeprom.MassRpt = append(eeprom.MassRpt, &kentpb.DispenserEepromMassData{Idx: i, RunMax: 3, DispensingTimeoutMs: 30000})
+	}
+	for i := uint32(0); i < NB_OF_SIM_TEMP_CONTROLLERS; i++ {
+		eeprom.TemperatureRpt = append(eeprom.TemperatureRpt, &kentpb.EepromTemperatureControlData{Idx: i, FTemperatureC: -1800, FToleranceC: 200, Mode: kentpb.EepromTemperatureControlData_TCM_COOLING})
+	}
+	if kind == simFryer {
+		for i := uint32(0); i < NB_OF_SIM_TRANSPORTS; i++ {
+			eeprom.TransportRpt = append(eeprom.TransportRpt, &kentpb.EepromPositionsRequest{Idx: i, Position: []int32{0, 1200, 2400, 3600}, Tolerance: 10})
+		}
+	}
+
+	return eeprom
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+)
+
+func TestSimulatedDispenser(t *testing.T) {
+
+	ctx := startBridge(t, bridgeConfig{Simulate: simDispenser})
+	id := ctx.sim.devices[0].id
+	waitFor(t, testWait, "the simulated dispenser to come online", func() bool {
+		return ctx.devices.isOnline(id)
+	})
+	client := dialBridge(t, ctx, "?devices="+id.String())
+
+	state := func(what string) uint64 {
+		msg := client.expect(t, what, func(msg wsMsg) bool {
+			return msg.Type == wsMsgKent && reportName(client.decodeReport(t, msg)) == "DispenserStateRpt"
+		})
+		return uint64(client.decodeReport(t, msg).GetDispenserStateRpt().GetState())
+	}
+
+	client.send(t, id, "1", &kentpb.SrvToCli{ReqOneof: &kentpb.SrvToCli_DispenserProcessReq{
+		DispenserProcessReq: &kentpb.DispenserProcessRequest{MassMg: 1000, SimulationTimeMs: 300},
+	}})
+	if got := state("the dispense to start"); got != simDispenserDispensing {
+		t.Fatalf("dispensing in state %d", got)
+	}
+	client.expect(t, "the process response", func(msg wsMsg) bool {
+		return msg.Type == wsMsgKent && reportName(client.decodeReport(t, msg)) == "DispenserProcessResp"
+	})
+	if got := state("the dispense to end"); got != simDispenserIdle {
+		t.Fatalf("idle in state %d", got)
+	}
+
+	// A dispense still running when the bridge stops is waited for
+	client.send(t, id, "2", &kentpb.SrvToCli{ReqOneof: &kentpb.SrvToCli_DispenserProcessReq{
+		DispenserProcessReq: &kentpb.DispenserProcessRequest{MassMg: 1000, SimulationTimeMs: 60000},
+	}})
+	state("the second dispense to start")
+	if err := ctx.stop(); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.devices.isOnline(id) {
+		t.Fatal("the simulated dispenser is still online")
+	}
+	if _, err := newSimulator("toaster"); err == nil {
+		t.Fatal("simulating an unknown device")
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iwdfryer/kent/proto/kentpb"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+/*
+Report storage, every live report a dispenser sends is appended as a JSON line to
+<dir>/<dispenser ID>/<YYYY-MM-DD>.jsonl, one file per dispenser per UTC day, also
+the ones -reports and -ignoreReports keep from the websocket clients. Days older
+than the retention are deleted.
+*/
+
+const (
+	// Time between two looks for days past the retention.
+	storeCleanInterval = time.Hour
+
+	// Reports returned by a query when it gives no limit.
+	storeDefaultLimit = 10000
+
+	storeDayLayout = "2006-01-02"
+)
+
+/*
+storedReport - One line of a report file.
+*/
+type storedReport struct {
+	Time   time.Time       `json:"time"`
+	Type   string          `json:"type"`
+	Report json.RawMessage `json:"report"`
+}
+
+/*
+storeFile - The file reports of a dispenser are appended to today.
+*/
+type storeFile struct {
+	day  string
+	file *os.File
+}
+
+/*
+reportStore - Append-only report files per dispenser per day.
+*/
+type reportStore struct {
+	mutex     sync.Mutex
+	dir       string
+	retention time.Duration
+	files     map[uuid.UUID]*storeFile
+	done      chan struct{}
+}
+
+func newReportStore(dir string, retention time.Duration) (*reportStore, error) {
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	rs := &reportStore{
+		dir:       dir,
+		retention: retention,
+		files:     make(map[uuid.UUID]*storeFile),
+		done:      make(chan struct{}),
+	}
+
+	if retention > 0 {
+		rs.clean()
+		go rs.cleaner()
+	}
+
+	return rs, nil
+}
+
+/*
+append - Store a report from a dispenser. Safe to call on a nil store when storage
+is disabled.
+*/
+func (rs *reportStore) append(dispenserID uuid.UUID, rpt *kentpb.CliToSrv) {
+
+	if rs == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+
+	b, err := protojson.Marshal(rpt)
+	if err != nil {
+		log.Println("store: marshalling", reportName(rpt), err)
+		return
+	}
+	line, err := json.Marshal(storedReport{
+		Time:   now,
+		Type:   reportName(rpt),
+		Report: b,
+	})
+	if err != nil {
+		log.Println("store:", err)
+		return
+	}
+	line = append(line, '\n')
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	day := now.Format(storeDayLayout)
+	sf, ok := rs.files[dispenserID]
+	if !ok || sf.day != day {
+		if ok {
+			sf.file.Close()
+			delete(rs.files, dispenserID)
+		}
+
+		dir := filepath.Join(rs.dir, dispenserID.String())
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			log.Println("store:", err)
+			return
+		}
+		f, err := os.OpenFile(filepath.Join(dir, day+".jsonl"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			log.Println("store:", err)
+			return
+		}
+		sf = &storeFile{day: day, file: f}
+		rs.files[dispenserID] = sf
+	}
+
+	if _, err := sf.file.Write(line); err != nil {
+		log.Println("store: writing", sf.file.Name(), err)
+	}
+}
+
+/*
+release - Close the file of a dispenser that went offline, it is opened again with
+its next report. Safe to call on a nil store.
+*/
+func (rs *reportStore) release(dispenserID uuid.UUID) {
+
+	if rs == nil {
+		return
+	}
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if sf, ok := rs.files[dispenserID]; ok {
+		sf.file.Close()
+		delete(rs.files, dispenserID)
+	}
+}
+
+/*
+query - Call fn with the stored reports of a dispenser between from and to, oldest
+first, only those of type typ when it isn't empty. Zero times leave the range open.
+*/
+func (rs *reportStore) query(dispenserID uuid.UUID, typ string, from time.Time, to time.Time, fn func(r storedReport) error) error {
+
+	dir := filepath.Join(rs.dir, dispenserID.String())
+	names, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		day, err := time.Parse(storeDayLayout, strings.TrimSuffix(filepath.Base(name), ".jsonl"))
+		if err != nil {
+			continue
+		}
+		if !from.IsZero() && !day.AddDate(0, 0, 1).After(from) {
+			continue
+		}
+		if !to.IsZero() && !day.Before(to) {
+			continue
+		}
+
+		if err := queryFile(name, typ, from, to, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func queryFile(name string, typ string, from time.Time, to time.Time, fn func(r storedReport) error) error {
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var r storedReport
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// A line cut short by a crash, the next ones are still good
+			continue
+		}
+		if typ != "" && r.Type != typ {
+			continue
+		}
+		if !from.IsZero() && r.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !r.Time.Before(to) {
+			continue
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading %s: %w", name, err)
+	}
+	return nil
+}
+
+/*
+clean - Delete the days past the retention.
+*/
+func (rs *reportStore) clean() {
+
+	oldest := time.Now().UTC().Add(-rs.retention)
+
+	names, err := filepath.Glob(filepath.Join(rs.dir, "*", "*.jsonl"))
+	if err != nil {
+		log.Println("store:", err)
+		return
+	}
+
+	for _, name := range names {
+		day, err := time.Parse(storeDayLayout, strings.TrimSuffix(filepath.Base(name), ".jsonl"))
+		if err != nil {
+			continue
+		}
+		// A day is kept until its last report is past the retention
+		if day.AddDate(0, 0, 1).Before(oldest) {
+			if err := os.Remove(name); err != nil {
+				log.Println("store:", err)
+			}
+		}
+	}
+}
+
+func (rs *reportStore) cleaner() {
+
+	ticker := time.NewTicker(storeCleanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rs.done:
+			return
+		case <-ticker.C:
+			rs.clean()
+		}
+	}
+}
+
+/*
+close - Stop cleaning and close the open files. Safe to call on a nil store.
+*/
+func (rs *reportStore) close() error {
+
+	if rs == nil {
+		return nil
+	}
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	select {
+	case <-rs.done:
+		return nil
+	default:
+		close(rs.done)
+	}
+
+	var err error
+	for id, sf := range rs.files {
+		if cerr := sf.file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(rs.files, id)
+	}
+
+	return err
+}
+
+/*
+restReports - GET /devices/{id}/reports, the stored reports of a dispenser as a JSON
+array, oldest first:
+
+	?type=<report>     Only reports of this type, ex: FryerStateRpt
+	?since=<time>      Only reports at or after this RFC3339 time
+	?until=<time>      Only reports before this RFC3339 time
+	?limit=<n>         At most n reports
+*/
+func (ctx *bridgeCtx) restReports(w http.ResponseWriter, r *http.Request, dispenserID uuid.UUID) {
+
+	if ctx.store == nil {
+		http.Error(w, "report storage is disabled", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+
+	var from, to time.Time
+	var err error
+	if s := q.Get("since"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("until"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "until: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := storeDefaultLimit
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	errLimit := errors.New("limit reached")
+	reports := []storedReport{}
+	err = ctx.store.query(dispenserID, q.Get("type"), from, to, func(rpt storedReport) error {
+		reports = append(reports, rpt)
+		if len(reports) >= limit {
+			return errLimit
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errLimit) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	restJSON(w, http.StatusOK, reports)
+}